@@ -0,0 +1,40 @@
+package tokensource
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+const quotaProjectHeader = "X-Goog-User-Project"
+
+// NewClient returns http.Client which authorizes requests with the access token of SmartAccessTokenSourceWithOptions.
+// It also sends X-Goog-User-Project header if the quota project is configured, which oauth2.NewClient doesn't.
+// Like oauth2.NewClient, the base transport is taken from oauth2.HTTPClient value of ctx.
+func NewClient(ctx context.Context, opts SmartOptions) (*http.Client, error) {
+	ts, err := SmartAccessTokenSourceWithOptions(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	client := oauth2.NewClient(ctx, ts)
+	if quotaProject := QuotaProject(ts); quotaProject != "" {
+		client.Transport = &quotaProjectTransport{base: client.Transport, quotaProject: quotaProject}
+	}
+	return client, nil
+}
+
+// quotaProjectTransport sets X-Goog-User-Project header unless it is already set.
+type quotaProjectTransport struct {
+	base         http.RoundTripper
+	quotaProject string
+}
+
+func (t *quotaProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(quotaProjectHeader) != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(quotaProjectHeader, t.quotaProject)
+	return t.base.RoundTrip(req)
+}
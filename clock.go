@@ -0,0 +1,67 @@
+package tokensource
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// Clock is the source of time used by AsyncTokenSource.
+// It can be replaced for deterministic testing of refresh timing.
+type Clock interface {
+	Now() time.Time
+	// NewTimer creates a new Timer which fires after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the timer created by Clock.
+type Timer interface {
+	// C returns the channel which receives the time when the Timer fires.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing.
+	Stop() bool
+}
+
+// realClock is the default Clock using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// backoffTimer adapts Clock to backoff.Timer.
+type backoffTimer struct {
+	clock Clock
+	timer Timer
+}
+
+var _ backoff.Timer = (*backoffTimer)(nil)
+
+func (t *backoffTimer) Start(d time.Duration) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = t.clock.NewTimer(d)
+}
+
+func (t *backoffTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *backoffTimer) C() <-chan time.Time {
+	return t.timer.C()
+}
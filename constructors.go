@@ -0,0 +1,54 @@
+package tokensource
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// Constructors are the constructors of the underlying token sources used by the smart token sources.
+// Replace them in tests to verify the resolution (e.g. the parsed delegate chain) without network access.
+// Nil fields fall back to the functions of google.golang.org/api and golang.org/x/oauth2/google.
+type Constructors struct {
+	// ImpersonatedCredentials defaults to impersonate.CredentialsTokenSource.
+	ImpersonatedCredentials func(ctx context.Context, config impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error)
+	// ImpersonatedIDToken defaults to impersonate.IDTokenSource.
+	ImpersonatedIDToken func(ctx context.Context, config impersonate.IDTokenConfig, opts ...option.ClientOption) (oauth2.TokenSource, error)
+	// IDToken defaults to idtoken.NewTokenSource.
+	IDToken func(ctx context.Context, audience string, opts ...option.ClientOption) (oauth2.TokenSource, error)
+	// FindDefaultCredentials defaults to google.FindDefaultCredentials.
+	// It is used when neither ClientOptions, CredentialsFile nor Subject is set.
+	FindDefaultCredentials func(ctx context.Context, scopes ...string) (*google.Credentials, error)
+}
+
+func (c Constructors) impersonatedCredentials(ctx context.Context, config impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	if c.ImpersonatedCredentials != nil {
+		return c.ImpersonatedCredentials(ctx, config, opts...)
+	}
+	return impersonate.CredentialsTokenSource(ctx, config, opts...)
+}
+
+func (c Constructors) impersonatedIDToken(ctx context.Context, config impersonate.IDTokenConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	if c.ImpersonatedIDToken != nil {
+		return c.ImpersonatedIDToken(ctx, config, opts...)
+	}
+	return impersonate.IDTokenSource(ctx, config, opts...)
+}
+
+func (c Constructors) idToken(ctx context.Context, audience string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	if c.IDToken != nil {
+		return c.IDToken(ctx, audience, opts...)
+	}
+	return idtoken.NewTokenSource(ctx, audience, opts...)
+}
+
+func (c Constructors) findDefaultCredentials(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+	if c.FindDefaultCredentials != nil {
+		return c.FindDefaultCredentials(ctx, scopes...)
+	}
+	return google.FindDefaultCredentials(ctx, scopes...)
+}
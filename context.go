@@ -0,0 +1,27 @@
+package tokensource
+
+import (
+	"context"
+	"time"
+)
+
+// valueOnlyContext is context.Context which carries the values of the parent but is never cancelled.
+type valueOnlyContext struct {
+	parent context.Context
+}
+
+func (valueOnlyContext) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (valueOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueOnlyContext) Err() error {
+	return nil
+}
+
+func (c valueOnlyContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
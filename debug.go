@@ -0,0 +1,290 @@
+package tokensource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveKeys are the normalized keys (see isSensitiveKey) of form values and JSON fields which must not be logged.
+var sensitiveKeys = map[string]bool{
+	"accesstoken":  true,
+	"actortoken":   true,
+	"assertion":    true,
+	"clientsecret": true,
+	"idtoken":      true,
+	"password":     true,
+	"privatekey":   true,
+	"refreshtoken": true,
+	"signedjwt":    true,
+	"subjecttoken": true,
+	"token":        true,
+}
+
+// isSensitiveKey reports whether key is sensitive in any case and with or without underscores,
+// e.g. both "access_token" of OAuth 2.0 and "accessToken" of IAM Credentials API.
+func isSensitiveKey(key string) bool {
+	return sensitiveKeys[strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))]
+}
+
+// withDebugHTTPClient returns the context which carries the HTTP client to log token refreshing requests.
+// It is only effective for the token sources respecting oauth2.HTTPClient context value.
+func withDebugHTTPClient(ctx context.Context, logger Logger) context.Context {
+	client := &http.Client{}
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && c != nil {
+		cc := *c
+		client = &cc
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &debugTransport{base: base, logger: logger}
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
+
+// debugTransport logs requests and responses with secrets redacted.
+type debugTransport struct {
+	base   http.RoundTripper
+	logger Logger
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	reqBody, err := readAndRestore(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	u := *req.URL
+	u.RawQuery = redactForm(u.Query()).Encode()
+	t.logger.Debugf("tokensource debug: request %s %s body=%s", req.Method, u.Redacted(), redactBody(req.Header.Get("Content-Type"), reqBody))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.logger.Debugf("tokensource debug: request %s %s error: %v", req.Method, u.Redacted(), err)
+		return nil, err
+	}
+	respBody, err := readAndRestore(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.logger.Debugf("tokensource debug: response %s %s status=%q body=%s", req.Method, u.Redacted(), resp.Status, redactBody(resp.Header.Get("Content-Type"), respBody))
+	return resp, nil
+}
+
+// readAndRestore reads *body and replaces it with the in-memory copy.
+func readAndRestore(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// redactBody redacts sensitive values in JSON object or form encoded body.
+// Bodies in other formats are not logged because they can't be redacted safely.
+func redactBody(contentType string, b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err == nil {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			// A bare JSON value has no key to tell whether it is sensitive.
+			return redacted
+		}
+		redactedJSON, err := json.Marshal(redactJSON(v))
+		if err != nil {
+			return redacted
+		}
+		return string(redactedJSON)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/x-www-form-urlencoded" {
+		return redacted
+	}
+	if form, err := url.ParseQuery(string(b)); err == nil {
+		return redactForm(form).Encode()
+	}
+	return redacted
+}
+
+// redactJSON redacts sensitive values in the nested objects and arrays of v.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if isSensitiveKey(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	}
+	return v
+}
+
+func redactForm(form url.Values) url.Values {
+	for k := range form {
+		if isSensitiveKey(k) {
+			form[k] = []string{redacted}
+		}
+	}
+	return form
+}
+
+// configSummary is the JSON representation of AsyncRefreshingConfig.
+// Functions and interfaces can't be serialized, so only whether they are customized is reported.
+type configSummary struct {
+	MarginBeforeExpiry                       string   `json:"margin_before_expiry"`
+	RandomizationFactorForMarginBeforeExpiry float64  `json:"randomization_factor_for_margin_before_expiry"`
+	MarginJitterOneSided                     bool     `json:"margin_jitter_one_sided"`
+	RefreshInterval                          string   `json:"refresh_interval"`
+	RandomizationFactorForRefreshInterval    float64  `json:"randomization_factor_for_refresh_interval"`
+	InitialJitterFactor                      float64  `json:"initial_jitter_factor"`
+	SyncRetryJitterFactor                    float64  `json:"sync_retry_jitter_factor"`
+	CombineIntervalAndExpiry                 bool     `json:"combine_interval_and_expiry"`
+	PermanentWithoutExpiry                   bool     `json:"permanent_without_expiry"`
+	AutoExtendRefreshInterval                bool     `json:"auto_extend_refresh_interval"`
+	WarmUpPeriod                             string   `json:"warm_up_period"`
+	MinRefreshWait                           string   `json:"min_refresh_wait"`
+	MaxRefreshInterval                       string   `json:"max_refresh_interval"`
+	MinForceRefreshInterval                  string   `json:"min_force_refresh_interval"`
+	CircuitBreakerThreshold                  int      `json:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown                   string   `json:"circuit_breaker_cooldown"`
+	NormalizeTokenType                       bool     `json:"normalize_token_type"`
+	ExpectedScopes                           []string `json:"expected_scopes,omitempty"`
+	LazyInit                                 bool     `json:"lazy_init"`
+	ReuseGeneratedTokenSource                bool     `json:"reuse_generated_token_source"`
+	Debug                                    bool     `json:"debug"`
+	Backoff                                  bool     `json:"backoff"`
+	Retryable                                bool     `json:"retryable"`
+	BeforeRefresh                            bool     `json:"before_refresh"`
+	RefreshContext                           bool     `json:"refresh_context"`
+	OnRefresh                                bool     `json:"on_refresh"`
+	ValidateToken                            bool     `json:"validate_token"`
+	Tracer                                   bool     `json:"tracer"`
+	RandFloat64                              bool     `json:"rand_float64"`
+	Clock                                    bool     `json:"clock"`
+	Logger                                   bool     `json:"logger"`
+}
+
+func (conf AsyncRefreshingConfig) summary() configSummary {
+	_, defaultClock := conf.Clock.(realClock)
+	_, defaultLogger := conf.Logger.(nopLogger)
+	return configSummary{
+		MarginBeforeExpiry:                       conf.MarginBeforeExpiry.String(),
+		RandomizationFactorForMarginBeforeExpiry: conf.RandomizationFactorForMarginBeforeExpiry,
+		MarginJitterOneSided:                     conf.MarginJitterOneSided,
+		RefreshInterval:                          conf.RefreshInterval.String(),
+		RandomizationFactorForRefreshInterval:    conf.RandomizationFactorForRefreshInterval,
+		InitialJitterFactor:                      conf.InitialJitterFactor,
+		SyncRetryJitterFactor:                    conf.SyncRetryJitterFactor,
+		CombineIntervalAndExpiry:                 conf.CombineIntervalAndExpiry,
+		PermanentWithoutExpiry:                   conf.PermanentWithoutExpiry,
+		AutoExtendRefreshInterval:                conf.AutoExtendRefreshInterval,
+		WarmUpPeriod:                             conf.WarmUpPeriod.String(),
+		MinRefreshWait:                           conf.MinRefreshWait.String(),
+		MaxRefreshInterval:                       conf.MaxRefreshInterval.String(),
+		MinForceRefreshInterval:                  conf.MinForceRefreshInterval.String(),
+		CircuitBreakerThreshold:                  conf.CircuitBreakerThreshold,
+		CircuitBreakerCooldown:                   conf.CircuitBreakerCooldown.String(),
+		NormalizeTokenType:                       conf.NormalizeTokenType,
+		ExpectedScopes:                           conf.ExpectedScopes,
+		LazyInit:                                 conf.LazyInit,
+		ReuseGeneratedTokenSource:                conf.ReuseGeneratedTokenSource,
+		Debug:                                    conf.Debug,
+		Backoff:                                  conf.Backoff != nil || conf.NewBackoff != nil,
+		Retryable:                                conf.IsRetryable != nil,
+		BeforeRefresh:                            conf.BeforeRefresh != nil,
+		RefreshContext:                           conf.RefreshContext != nil,
+		OnRefresh:                                conf.OnRefresh != nil,
+		ValidateToken:                            conf.ValidateToken != nil,
+		Tracer:                                   conf.Tracer != nil,
+		RandFloat64:                              conf.RandFloat64 != nil,
+		Clock:                                    conf.Clock != nil && !defaultClock,
+		Logger:                                   conf.Logger != nil && !defaultLogger,
+	}
+}
+
+// MarshalJSON renders conf for logging. Functions and interfaces are rendered as booleans whether they are customized.
+func (conf AsyncRefreshingConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(conf.summary())
+}
+
+// String renders conf for logging, e.g. "interval=30m0s margin=5m0s backoff=custom retryable=set logger=default".
+// Zero durations mean the defaults are used.
+func (conf AsyncRefreshingConfig) String() string {
+	c := conf.summary()
+	custom := func(b bool) string {
+		if b {
+			return "custom"
+		}
+		return "default"
+	}
+	set := func(b bool) string {
+		if b {
+			return "set"
+		}
+		return "unset"
+	}
+	return fmt.Sprintf("interval=%s interval_jitter=%v margin=%s margin_jitter=%v margin_jitter_one_sided=%v initial_jitter=%v sync_retry_jitter=%v combine=%v permanent_without_expiry=%v auto_extend=%v warm_up=%s min_refresh_wait=%s max_refresh_interval=%s min_force_refresh_interval=%s circuit_breaker_threshold=%d circuit_breaker_cooldown=%s normalize_token_type=%v expected_scopes=%v lazy_init=%v reuse_token_source=%v debug=%v backoff=%s retryable=%s before_refresh=%s refresh_context=%s on_refresh=%s validate_token=%s tracer=%s rand=%s clock=%s logger=%s",
+		c.RefreshInterval, c.RandomizationFactorForRefreshInterval, c.MarginBeforeExpiry, c.RandomizationFactorForMarginBeforeExpiry, c.MarginJitterOneSided, c.InitialJitterFactor, c.SyncRetryJitterFactor,
+		c.CombineIntervalAndExpiry, c.PermanentWithoutExpiry, c.AutoExtendRefreshInterval, c.WarmUpPeriod, c.MinRefreshWait, c.MaxRefreshInterval, c.MinForceRefreshInterval, c.CircuitBreakerThreshold, c.CircuitBreakerCooldown, c.NormalizeTokenType, c.ExpectedScopes, c.LazyInit, c.ReuseGeneratedTokenSource, c.Debug,
+		custom(c.Backoff), set(c.Retryable), set(c.BeforeRefresh), set(c.RefreshContext), set(c.OnRefresh), set(c.ValidateToken), set(c.Tracer), custom(c.RandFloat64), custom(c.Clock), custom(c.Logger))
+}
+
+type debugState struct {
+	Config              configSummary `json:"config"`
+	Expiry              time.Time     `json:"expiry"`
+	NextRefresh         time.Time     `json:"next_refresh"`
+	LastRefresh         time.Time     `json:"last_refresh"`
+	LastError           string        `json:"last_error,omitempty"`
+	ConsecutiveFailures int64         `json:"consecutive_failures"`
+	CircuitOpenUntil    time.Time     `json:"circuit_open_until"`
+	Stats               Stats         `json:"stats"`
+}
+
+// DebugState returns the runtime state of ts as JSON for debug endpoints (e.g. /debug/tokensource).
+// It never contains secret materials like tokens.
+// Zero next_refresh means the next refresh is driven by RefreshInterval, or not scheduled with PermanentWithoutExpiry.
+func (ts *AsyncTokenSource) DebugState() ([]byte, error) {
+	ts.mu.Lock()
+	state := debugState{
+		Config:              ts.conf.summary(),
+		NextRefresh:         ts.nextRefresh,
+		LastRefresh:         ts.lastRefresh,
+		ConsecutiveFailures: ts.stats.ConsecutiveFailures,
+		CircuitOpenUntil:    ts.circuitOpenUntil,
+		Stats:               ts.stats,
+	}
+	if ts.token != nil {
+		state.Expiry = ts.token.Expiry
+	}
+	if ts.lastErr != nil {
+		state.LastError = ts.lastErr.Error()
+	}
+	ts.mu.Unlock()
+	return json.Marshal(state)
+}
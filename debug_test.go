@@ -0,0 +1,159 @@
+package tokensource_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/apstndb/tokensource"
+)
+
+// recordingLogger records all logs.
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("DEBUG", format, args...)
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("WARN", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("ERROR", format, args...)
+}
+
+func (l *recordingLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.logs, "\n")
+}
+
+func (l *recordingLogger) count(level string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var n int
+	for _, log := range l.logs {
+		if strings.HasPrefix(log, level+": ") {
+			n++
+		}
+	}
+	return n
+}
+
+// httpTokenSource exchanges the secrets for a token using the HTTP client in ctx like the token sources of golang.org/x/oauth2.
+type httpTokenSource struct {
+	ctx context.Context
+	url string
+}
+
+func (s httpTokenSource) Token() (*oauth2.Token, error) {
+	client := http.DefaultClient
+	if c, ok := s.ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+	resp, err := client.PostForm(s.url+"?access_token=secret-query", url.Values{
+		"client_secret": {"secret-client"},
+		"subject_token": {"secret-subject"},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:token-exchange"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: body.AccessToken, Expiry: body.ExpireTime}, nil
+}
+
+func TestDebug_RedactsSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			// The response of IAM Credentials API used by the impersonation of external accounts.
+			"accessToken": "secret-access",
+			"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"nested":      map[string]interface{}{"id_token": "secret-id", "Refresh-Token": "secret-refresh"},
+			"keys":        []interface{}{map[string]interface{}{"privateKey": "secret-key"}},
+		})
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return httpTokenSource{ctx: ctx, url: server.URL}, nil
+	}, tokensource.WithLogger(logger), func(c *tokensource.AsyncRefreshingConfig) { c.Debug = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "secret-access" {
+		t.Fatalf("the debug transport must not change the response, got %q", token.AccessToken)
+	}
+
+	out := logger.String()
+	if strings.Contains(out, "secret-") {
+		t.Errorf("secrets are logged:\n%s", out)
+	}
+	for _, want := range []string{"tokensource debug: request POST", "tokensource debug: response POST", "grant_type=", "expireTime", "REDACTED"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log must contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "secret-access", RefreshToken: "secret-refresh", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(token), nil
+	}, tokensource.WithMarginBeforeExpiry(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	b, err := ts.DebugState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret-") {
+		t.Errorf("DebugState must not contain secrets: %s", b)
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"config", "expiry", "next_refresh", "last_refresh", "consecutive_failures", "circuit_open_until", "stats"} {
+		if _, ok := state[key]; !ok {
+			t.Errorf("DebugState must contain %q: %s", key, b)
+		}
+	}
+	if got := state["config"].(map[string]interface{})["margin_before_expiry"]; got != "10m0s" {
+		t.Errorf("config.margin_before_expiry: want 10m0s, got %v", got)
+	}
+}
@@ -0,0 +1,107 @@
+package tokensource
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/impersonate"
+)
+
+// DelegateResolver resolves the delegate chain to impersonate target principal.
+// It is useful when the delegate chain is managed outside of the process (e.g. a policy service).
+type DelegateResolver func(ctx context.Context, target string) ([]string, error)
+
+type cachedDelegates struct {
+	delegates []string
+	expiry    time.Time
+}
+
+// CachingDelegateResolver wraps resolver to cache the resolved delegate chain of each target for ttl.
+// Errors are not cached. Concurrent calls for the same target share one call of resolver without blocking the other targets,
+// and each caller waits for it until its own ctx is done. The shared call isn't cancelled by ctx, so resolver should bound its own time.
+func CachingDelegateResolver(resolver DelegateResolver, ttl time.Duration) DelegateResolver {
+	var mu sync.Mutex
+	var group singleflight.Group
+	cache := make(map[string]cachedDelegates)
+	return func(ctx context.Context, target string) ([]string, error) {
+		mu.Lock()
+		c, ok := cache[target]
+		mu.Unlock()
+		if ok && time.Now().Before(c.expiry) {
+			return append([]string(nil), c.delegates...), nil
+		}
+		resultC := group.DoChan(target, func() (interface{}, error) {
+			delegates, err := resolver(valueOnlyContext{parent: ctx}, target)
+			if err != nil {
+				return nil, err
+			}
+			delegates = append([]string(nil), delegates...)
+			mu.Lock()
+			cache[target] = cachedDelegates{delegates: delegates, expiry: time.Now().Add(ttl)}
+			mu.Unlock()
+			return delegates, nil
+		})
+		select {
+		case r := <-resultC:
+			if r.Err != nil {
+				return nil, r.Err
+			}
+			return append([]string(nil), r.Val.([]string)...), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ResolvedAccessTokenSource generate oauth2.TokenSource which generates access token impersonating target
+// with the delegate chain resolved by resolver.
+// The delegate chain is resolved every time it is called, so use it in genFunc of AsyncTokenSource to resolve it at refresh time.
+func ResolvedAccessTokenSource(ctx context.Context, target string, resolver DelegateResolver, scopes ...string) (oauth2.TokenSource, error) {
+	return ResolvedAccessTokenSourceWithConstructors(ctx, target, resolver, Constructors{}, scopes...)
+}
+
+// ResolvedAccessTokenSourceWithConstructors is ResolvedAccessTokenSource which impersonates with constructors, e.g. in tests.
+func ResolvedAccessTokenSourceWithConstructors(ctx context.Context, target string, resolver DelegateResolver, constructors Constructors, scopes ...string) (oauth2.TokenSource, error) {
+	delegates, err := resolver(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := impersonatedAccessTokenSource(ctx, constructors, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Delegates:       delegates,
+		Scopes:          scopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// ResolvedIDTokenSource generate oauth2.TokenSource which generates ID token impersonating target
+// with the delegate chain resolved by resolver.
+// The delegate chain is resolved every time it is called, so use it in genFunc of AsyncTokenSource to resolve it at refresh time.
+func ResolvedIDTokenSource(ctx context.Context, target string, resolver DelegateResolver, audience string) (oauth2.TokenSource, error) {
+	return ResolvedIDTokenSourceWithConstructors(ctx, target, resolver, audience, Constructors{})
+}
+
+// ResolvedIDTokenSourceWithConstructors is ResolvedIDTokenSource which impersonates with constructors, e.g. in tests.
+func ResolvedIDTokenSourceWithConstructors(ctx context.Context, target string, resolver DelegateResolver, audience string, constructors Constructors) (oauth2.TokenSource, error) {
+	delegates, err := resolver(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := impersonatedIDTokenSource(ctx, constructors, impersonate.IDTokenConfig{
+		Audience:        audience,
+		TargetPrincipal: target,
+		Delegates:       delegates,
+		// Cloud IAP requires email claim.
+		IncludeEmail: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
@@ -0,0 +1,100 @@
+package tokensource_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+
+	"github.com/apstndb/tokensource"
+	"github.com/apstndb/tokensource/tokensourcetest"
+)
+
+func TestCachingDelegateResolver(t *testing.T) {
+	var calls int32
+	resolver := tokensource.CachingDelegateResolver(func(ctx context.Context, target string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		return []string{"delegate-of-" + target}, nil
+	}, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		got, err := resolver(context.Background(), "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"delegate-of-a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+		// The returned slice must not alias the cache.
+		got[0] = "mutated"
+	}
+	if calls != 1 {
+		t.Errorf("the resolved delegate chain must be cached, but resolver is called %d times", calls)
+	}
+}
+
+func TestCachingDelegateResolver_SlowTargetDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	resolver := tokensource.CachingDelegateResolver(func(ctx context.Context, target string) ([]string, error) {
+		if target == "slow" {
+			<-release
+		}
+		return []string{target}, nil
+	}, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := resolver(ctx, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded while the resolver is blocked, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := resolver(ctx, "fast"); err != nil {
+		t.Errorf("the other target must not wait for the slow resolver: %v", err)
+	}
+}
+
+func TestResolvedTokenSources_ApplyResolvedDelegates(t *testing.T) {
+	const target = "target@p.iam.gserviceaccount.com"
+	want := []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"}
+	resolver := func(ctx context.Context, gotTarget string) ([]string, error) {
+		if gotTarget != target {
+			t.Errorf("resolver: want target %q, got %q", target, gotTarget)
+		}
+		return want, nil
+	}
+	var accessConfig impersonate.CredentialsConfig
+	var idConfig impersonate.IDTokenConfig
+	constructors := tokensource.Constructors{
+		ImpersonatedCredentials: func(ctx context.Context, config impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+			accessConfig = config
+			return tokensourcetest.NewFakeTokenSource(), nil
+		},
+		ImpersonatedIDToken: func(ctx context.Context, config impersonate.IDTokenConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+			idConfig = config
+			return tokensourcetest.NewFakeTokenSource(), nil
+		},
+	}
+
+	if _, err := tokensource.ResolvedAccessTokenSourceWithConstructors(context.Background(), target, resolver, constructors, "scope-a"); err != nil {
+		t.Fatal(err)
+	}
+	if accessConfig.TargetPrincipal != target || !reflect.DeepEqual(accessConfig.Delegates, want) || !reflect.DeepEqual(accessConfig.Scopes, []string{"scope-a"}) {
+		t.Errorf("CredentialsConfig: want target %q, delegates %v and scopes [scope-a], got %+v", target, want, accessConfig)
+	}
+
+	if _, err := tokensource.ResolvedIDTokenSourceWithConstructors(context.Background(), target, resolver, "https://example.com", constructors); err != nil {
+		t.Fatal(err)
+	}
+	if idConfig.TargetPrincipal != target || !reflect.DeepEqual(idConfig.Delegates, want) || idConfig.Audience != "https://example.com" || !idConfig.IncludeEmail {
+		t.Errorf("IDTokenConfig: want target %q, delegates %v, audience and email, got %+v", target, want, idConfig)
+	}
+}
@@ -0,0 +1,60 @@
+package tokensource
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
+)
+
+// EnvInfo describes how the smart token sources resolve the credentials in the current environment.
+type EnvInfo struct {
+	// Strategy is the strategy which StrategyAuto resolves to.
+	Strategy Strategy
+	// Identity is the principal of the tokens as far as it is discoverable without generating a token.
+	Identity Identity
+	// CredentialsType is the type of the credentials file found by ADC (e.g. "service_account", "authorized_user", "external_account").
+	// It is empty for impersonation and the metadata server.
+	CredentialsType string
+	// MetadataServer reports whether the metadata server is reachable.
+	MetadataServer bool
+	// QuotaProject is the quota project used by SmartAccessTokenSource.
+	QuotaProject string
+}
+
+// DescribeEnvironment reports what SmartAccessTokenSource would do in the current environment, for troubleshooting.
+// It doesn't generate any token, so the returned EnvInfo doesn't guarantee the token generation succeeds.
+// If ADC is not found, the error is returned with EnvInfo filled as far as possible.
+func DescribeEnvironment(ctx context.Context) (EnvInfo, error) {
+	info := EnvInfo{
+		MetadataServer: metadata.OnGCE(),
+		QuotaProject:   os.Getenv(coreProjectEnvName),
+	}
+	if impSaVal := os.Getenv(impSaEnvName); impSaVal != "" {
+		targetPrincipal, delegates, err := ParseDelegateChainE(impSaVal)
+		if err != nil {
+			return info, err
+		}
+		info.Strategy, info.Identity = StrategyImpersonate, impersonatedIdentity(targetPrincipal, delegates)
+		return info, nil
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx)
+	if err != nil {
+		return info, err
+	}
+	if len(creds.JSON) == 0 {
+		info.Strategy = StrategyMetadata
+		return info, nil
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(creds.JSON, &f); err != nil {
+		return info, err
+	}
+	info.Strategy, info.Identity, info.CredentialsType = StrategyADC, credentialsIdentity(creds.JSON), f.Type
+	return info, nil
+}
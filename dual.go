@@ -0,0 +1,58 @@
+package tokensource
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/idtoken"
+)
+
+// DualTokenSource provides both access token and ID token of the same identity.
+type DualTokenSource struct {
+	accessTokenSource oauth2.TokenSource
+	idTokenSource     oauth2.TokenSource
+}
+
+// AccessTokenSource returns oauth2.TokenSource which generates access token.
+func (d *DualTokenSource) AccessTokenSource() oauth2.TokenSource {
+	return d.accessTokenSource
+}
+
+// IDTokenSource returns oauth2.TokenSource which generates ID token.
+func (d *DualTokenSource) IDTokenSource() oauth2.TokenSource {
+	return d.idTokenSource
+}
+
+// SmartDualTokenSource generate DualTokenSource which supports CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT environment variable
+// like SmartAccessTokenSource and SmartIDTokenSource.
+// The environment variable is resolved once, so both token sources always share the same delegate chain.
+func SmartDualTokenSource(ctx context.Context, audience string, scopes ...string) (*DualTokenSource, error) {
+	if impSaVal := os.Getenv(impSaEnvName); impSaVal != "" {
+		targetPrincipal, delegates, err := ParseDelegateChainE(impSaVal)
+		if err != nil {
+			return nil, err
+		}
+		accessTokenSource, err := ImpersonatedAccessTokenSource(ctx, targetPrincipal, delegates, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		// Cloud IAP requires email claim.
+		idTokenSource, err := ImpersonatedIDTokenSource(ctx, targetPrincipal, delegates, audience, true)
+		if err != nil {
+			return nil, err
+		}
+		return &DualTokenSource{accessTokenSource: accessTokenSource, idTokenSource: idTokenSource}, nil
+	}
+
+	accessTokenSource, err := google.DefaultTokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	idTokenSource, err := idtoken.NewTokenSource(ctx, audience)
+	if err != nil {
+		return nil, err
+	}
+	return &DualTokenSource{accessTokenSource: accessTokenSource, idTokenSource: idTokenSource}, nil
+}
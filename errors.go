@@ -0,0 +1,62 @@
+package tokensource
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoToken matches RefreshError by errors.Is if no token has ever been fetched successfully.
+// It distinguishes a cold start failure from a failure to refresh the existing token.
+var ErrNoToken = errors.New("no token has been fetched")
+
+// RefreshError is returned when AsyncTokenSource fails to fetch a token.
+// It wraps the cause, so errors.Is and errors.As work for the cause (e.g. context.Canceled).
+type RefreshError struct {
+	// Err is the cause of the last attempt.
+	Err error
+	// Attempts is the number of attempts including retries.
+	Attempts int
+	// Elapsed is the duration of all attempts.
+	Elapsed time.Duration
+	// HasToken reports whether a token had been fetched before this failure.
+	HasToken bool
+}
+
+func (e *RefreshError) Error() string {
+	return fmt.Sprintf("token refresh failed after %d attempt(s) in %v: %v", e.Attempts, e.Elapsed, e.Err)
+}
+
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrNoToken and no token had been fetched.
+func (e *RefreshError) Is(target error) bool {
+	return target == ErrNoToken && !e.HasToken
+}
+
+// ErrCircuitOpen matches CircuitOpenError by errors.Is.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned by Token() while the circuit breaker is open and no unexpired token is cached.
+// It wraps the last refresh error.
+type CircuitOpenError struct {
+	// Err is the last refresh error.
+	Err error
+	// Until is when the circuit breaker allows the next refresh attempt.
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v until %v: %v", ErrCircuitOpen, e.Until.Format(time.RFC3339), e.Err)
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrCircuitOpen.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
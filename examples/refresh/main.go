@@ -33,17 +33,18 @@ func _main() error {
 		}
 	} else {
 		generatorFunc = func(ctx context.Context) (oauth2.TokenSource, error) {
-			return tokensource.SmartAccessTokenSource(ctx, cloudPlatformScope)
+			return tokensource.SmartAccessTokenSource(ctx, tokensource.ScopesFromEnv(cloudPlatformScope)...)
 		}
 	}
-	tokenSource, err := tokensource.AsyncRefreshingTokenSource(ctx, tokensource.AsyncRefreshingConfig{
+	tokenSource, err := tokensource.NewAsyncRefreshingTokenSource(ctx, tokensource.AsyncRefreshingConfig{
 		RandomizationFactorForRefreshInterval: 0.5,
 		RefreshInterval:                       30 * time.Second,
-		Backoff: func() backoff.BackOff {
+		NewBackoff: func() backoff.BackOff {
 			b := backoff.NewExponentialBackOff()
 			b.MaxElapsedTime = 1 * time.Minute
 			return b
-		}(),
+		},
+		IsRetryable: tokensource.DefaultGoogleRetryable,
 	}, generatorFunc)
 	if err != nil {
 		return err
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http/httputil"
 	"os"
 
@@ -12,8 +13,6 @@ import (
 	"golang.org/x/oauth2"
 )
 
-const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
-
 func main() {
 	if err := _main(); err != nil {
 		panic(err)
@@ -23,12 +22,19 @@ func main() {
 func _main() error {
 	aud := flag.String("audience", "", "")
 	printTokenFlag := flag.Bool("print-token", false, "")
+	describeFlag := flag.Bool("describe", false, "print how the credentials are resolved without generating token")
 	flag.Parse()
 
 	url := flag.Arg(0)
 
 	ctx := context.Background()
 
+	if *describeFlag {
+		info, err := tokensource.DescribeEnvironment(ctx)
+		fmt.Printf("%+v\n", info)
+		return err
+	}
+
 	var tokenSource oauth2.TokenSource
 	if *aud != "" {
 		ts, err := tokensource.SmartIDTokenSource(ctx, *aud)
@@ -37,7 +43,7 @@ func _main() error {
 		}
 		tokenSource = ts
 	} else {
-		ts, err := tokensource.SmartAccessTokenSource(ctx, cloudPlatformScope)
+		ts, err := tokensource.SmartTokenSourceForTarget(ctx, url)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,73 @@
+package tokensource
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// FallbackError is returned by the TokenSource of FallbackTokenSource when all sources fail.
+// errors.Is and errors.As match any of Errs.
+type FallbackError struct {
+	Errs []error
+}
+
+func (e *FallbackError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "all token sources failed: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns Errs. It is respected by errors.Is and errors.As since Go 1.20.
+func (e *FallbackError) Unwrap() []error {
+	return e.Errs
+}
+
+// Is reports whether any of Errs matches target.
+func (e *FallbackError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in Errs that matches target.
+func (e *FallbackError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type fallbackTokenSource struct {
+	sources []oauth2.TokenSource
+}
+
+// FallbackTokenSource returns oauth2.TokenSource which tries sources in order and returns the first token successfully retrieved.
+// If all sources fail, *FallbackError is returned.
+// e.g. FallbackTokenSource(impersonatedTokenSource, adcTokenSource) falls back to ADC when the impersonation is not permitted.
+func FallbackTokenSource(sources ...oauth2.TokenSource) oauth2.TokenSource {
+	return &fallbackTokenSource{sources: append([]oauth2.TokenSource(nil), sources...)}
+}
+
+func (s *fallbackTokenSource) Token() (*oauth2.Token, error) {
+	var errs []error
+	for _, ts := range s.sources {
+		token, err := ts.Token()
+		if err == nil {
+			return token, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("FallbackTokenSource: no token source is given")
+	}
+	return nil, &FallbackError{Errs: errs}
+}
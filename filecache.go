@@ -0,0 +1,101 @@
+package tokensource
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fileCacheMargin is the safety margin before Expiry to serve the cached token.
+const fileCacheMargin = 1 * time.Minute
+
+type fileCachedTokenSource struct {
+	path  string
+	inner oauth2.TokenSource
+
+	mu sync.Mutex
+	// token is the in-memory copy of the cached token, so the file is touched only when it needs a refresh.
+	token *oauth2.Token
+}
+
+// NewFileCachedTokenSource returns oauth2.TokenSource which persists the token of inner to path with 0600 permission,
+// so the token can be reused across processes (e.g. frequently invoked CLI tools).
+// The cached token is served while it is valid for more than 1 minute. Tokens without Expiry are never served from the cache.
+// The token is also kept in memory, so the cache file is read and locked only when the token in memory needs a refresh.
+// Concurrent processes are serialized by the lock file path + ".lock" on the platforms supporting flock.
+// Unreadable or corrupt cache files are ignored, and failures to write the cache don't fail Token().
+func NewFileCachedTokenSource(path string, inner oauth2.TokenSource) oauth2.TokenSource {
+	return &fileCachedTokenSource{path: path, inner: inner}
+}
+
+func (s *fileCachedTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && fileCacheable(s.token) {
+		return cloneToken(s.token), nil
+	}
+
+	if unlock, err := lockFile(s.path + ".lock"); err == nil {
+		defer unlock()
+	}
+
+	// Another process may have refreshed the token.
+	if token, ok := s.read(); ok {
+		s.token = token
+		return cloneToken(token), nil
+	}
+	token, err := s.inner.Token()
+	if err != nil {
+		return nil, err
+	}
+	_ = s.write(token)
+	s.token = cloneToken(token)
+	return token, nil
+}
+
+func (s *fileCachedTokenSource) read() (*oauth2.Token, bool) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, false
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(b, &token); err != nil || !fileCacheable(&token) {
+		return nil, false
+	}
+	return &token, true
+}
+
+// fileCacheable reports whether token can be served from the cache.
+func fileCacheable(token *oauth2.Token) bool {
+	return token.AccessToken != "" && !token.Expiry.IsZero() && time.Until(token.Expiry) > fileCacheMargin
+}
+
+// write writes token atomically to avoid leaving partially written cache.
+func (s *fileCachedTokenSource) write(token *oauth2.Token) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
@@ -0,0 +1,108 @@
+package tokensource_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/apstndb/tokensource"
+	"github.com/apstndb/tokensource/tokensourcetest"
+)
+
+func readCachedToken(t *testing.T, path string) *oauth2.Token {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(b, &token); err != nil {
+		t.Fatal(err)
+	}
+	return &token
+}
+
+func TestFileCachedTokenSource_ServesFromMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	inner := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts := tokensource.NewFileCachedTokenSource(path, inner)
+
+	if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+		t.Fatalf("want the token of inner, got %v, %v", token, err)
+	}
+	if got := readCachedToken(t, path).AccessToken; got != "token" {
+		t.Errorf("want the token written to the cache file, got %q", got)
+	}
+
+	// The file is not read while the token in memory is valid.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+			t.Fatalf("want the cached token, got %v, %v", token, err)
+		}
+	}
+	if calls := inner.Calls(); calls != 1 {
+		t.Errorf("inner: want 1 call, got %d", calls)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want the cache file untouched, got %v", err)
+	}
+}
+
+func TestFileCachedTokenSource_RefreshesNearExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	// The token expires within the margin, so it is never served from the cache.
+	inner := tokensourcetest.NewFakeTokenSource(
+		tokensourcetest.TokenResponse("short", time.Now().Add(30*time.Second)),
+		tokensourcetest.TokenResponse("long", time.Now().Add(time.Hour)),
+	)
+	ts := tokensource.NewFileCachedTokenSource(path, inner)
+
+	for _, want := range []string{"short", "long", "long"} {
+		if token, err := ts.Token(); err != nil || token.AccessToken != want {
+			t.Fatalf("want %q, got %v, %v", want, token, err)
+		}
+	}
+	if calls := inner.Calls(); calls != 2 {
+		t.Errorf("inner: want 2 calls, got %d", calls)
+	}
+}
+
+func TestFileCachedTokenSource_SharesFileAcrossSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	first := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("first", time.Now().Add(time.Hour)))
+	if _, err := tokensource.NewFileCachedTokenSource(path, first).Token(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process reuses the cache file instead of calling its inner.
+	second := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("second", time.Now().Add(time.Hour)))
+	if token, err := tokensource.NewFileCachedTokenSource(path, second).Token(); err != nil || token.AccessToken != "first" {
+		t.Fatalf("want the token of the cache file, got %v, %v", token, err)
+	}
+	if calls := second.Calls(); calls != 0 {
+		t.Errorf("inner: want no call, got %d", calls)
+	}
+}
+
+func TestFileCachedTokenSource_IgnoresCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inner := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts := tokensource.NewFileCachedTokenSource(path, inner)
+
+	if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+		t.Fatalf("want the token of inner, got %v, %v", token, err)
+	}
+	if got := readCachedToken(t, path).AccessToken; got != "token" {
+		t.Errorf("want the corrupt file overwritten, got %q", got)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package tokensource
+
+import "errors"
+
+// lockFile is not supported on this platform, so concurrent processes may refresh the cache at the same time.
+func lockFile(path string) (func(), error) {
+	return nil, errors.New("file locking is not supported on this platform")
+}
@@ -0,0 +1,85 @@
+package tokensource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// gcloudConfigHelperOutput is the subset of the output of `gcloud config config-helper --format=json`.
+type gcloudConfigHelperOutput struct {
+	Credential struct {
+		AccessToken string    `json:"access_token"`
+		TokenExpiry time.Time `json:"token_expiry"`
+	} `json:"credential"`
+}
+
+type gcloudCachedTokenSource struct {
+	ctx    context.Context
+	scopes []string
+
+	mu       sync.Mutex
+	fallback oauth2.TokenSource
+}
+
+// GcloudCachedTokenSource generate oauth2.TokenSource which reuses the cached access token of the active gcloud account.
+// It is convenient for local development after `gcloud auth login`.
+// The token is read by `gcloud config config-helper`, so CLOUDSDK_CONFIG is respected and gcloud refreshes the cached token if needed.
+// If gcloud is not installed, fails, or returns an expired token, the token is generated by ADC with scopes instead.
+// Scopes are not applied to the gcloud token.
+func GcloudCachedTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	return oauth2.ReuseTokenSource(nil, &gcloudCachedTokenSource{ctx: ctx, scopes: scopes}), nil
+}
+
+func (s *gcloudCachedTokenSource) Token() (*oauth2.Token, error) {
+	if token, err := gcloudCachedToken(s.ctx); err == nil {
+		return token, nil
+	}
+	ts, err := s.fallbackTokenSource()
+	if err != nil {
+		return nil, err
+	}
+	return ts.Token()
+}
+
+// fallbackTokenSource lazily creates ADC TokenSource, so it isn't required while gcloud is available.
+func (s *gcloudCachedTokenSource) fallbackTokenSource() (oauth2.TokenSource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fallback != nil {
+		return s.fallback, nil
+	}
+	ts, err := google.DefaultTokenSource(s.ctx, s.scopes...)
+	if err != nil {
+		return nil, err
+	}
+	s.fallback = ts
+	return ts, nil
+}
+
+// gcloudCachedToken fails soft for any unexpected output, as the format may differ across gcloud versions.
+func gcloudCachedToken(ctx context.Context) (*oauth2.Token, error) {
+	out, err := exec.CommandContext(ctx, "gcloud", "config", "config-helper", "--format=json").Output()
+	if err != nil {
+		return nil, err
+	}
+	var helper gcloudConfigHelperOutput
+	if err := json.Unmarshal(out, &helper); err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{
+		AccessToken: helper.Credential.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      helper.Credential.TokenExpiry,
+	}
+	if token.AccessToken == "" || !token.Valid() {
+		return nil, errors.New("gcloud returned no valid access token")
+	}
+	return token, nil
+}
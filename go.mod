@@ -3,7 +3,10 @@ module github.com/apstndb/tokensource
 go 1.16
 
 require (
+	cloud.google.com/go v0.81.0
 	github.com/cenkalti/backoff/v4 v4.1.0
+	github.com/google/go-cmp v0.5.6 // indirect
 	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	google.golang.org/api v0.47.0
 )
@@ -0,0 +1,8 @@
+module github.com/apstndb/tokensource/grpccreds
+
+go 1.16
+
+require (
+	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
+	google.golang.org/grpc v1.37.1
+)
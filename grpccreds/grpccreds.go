@@ -0,0 +1,57 @@
+// Package grpccreds adapts oauth2.TokenSource to gRPC credentials.
+// It is a separate module, so the core module doesn't depend on gRPC.
+package grpccreds
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/credentials"
+)
+
+// contextTokenSource is implemented by the token sources which take context (e.g. *tokensource.AsyncTokenSource).
+type contextTokenSource interface {
+	TokenContext(ctx context.Context) (*oauth2.Token, error)
+}
+
+type perRPCCredentials struct {
+	ts                       oauth2.TokenSource
+	requireTransportSecurity bool
+}
+
+// PerRPCCredentials returns credentials.PerRPCCredentials which sets the token of ts to authorization metadata for each RPC.
+// If ts has TokenContext method, the RPC context bounds the wait for the token.
+func PerRPCCredentials(ts oauth2.TokenSource, requireTransportSecurity bool) credentials.PerRPCCredentials {
+	return &perRPCCredentials{ts: ts, requireTransportSecurity: requireTransportSecurity}
+}
+
+func (c *perRPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if c.requireTransportSecurity {
+		ri, _ := credentials.RequestInfoFromContext(ctx)
+		if err := credentials.CheckSecurityLevel(ri.AuthInfo, credentials.PrivacyAndIntegrity); err != nil {
+			return nil, fmt.Errorf("unable to transfer PerRPCCredentials: %w", err)
+		}
+	}
+	token, err := c.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"authorization": token.Type() + " " + token.AccessToken,
+	}, nil
+}
+
+func (c *perRPCCredentials) token(ctx context.Context) (*oauth2.Token, error) {
+	if cts, ok := c.ts.(contextTokenSource); ok {
+		return cts.TokenContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.ts.Token()
+}
+
+func (c *perRPCCredentials) RequireTransportSecurity() bool {
+	return c.requireTransportSecurity
+}
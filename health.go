@@ -0,0 +1,61 @@
+package tokensource
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// HealthCheckedTokenSource is oauth2.TokenSource which records the result of the last Token() call for readiness checks.
+type HealthCheckedTokenSource struct {
+	ts oauth2.TokenSource
+
+	mu        sync.Mutex
+	token     *oauth2.Token
+	err       error
+	lastCheck time.Time
+}
+
+// HealthChecked wraps ts to expose Healthy and LastCheck.
+// Results are recorded passively from Token() calls. Call Check to probe explicitly, e.g. in a readiness endpoint.
+func HealthChecked(ts oauth2.TokenSource) *HealthCheckedTokenSource {
+	return &HealthCheckedTokenSource{ts: ts}
+}
+
+// Token calls Token() of the wrapped source and records the result.
+func (h *HealthCheckedTokenSource) Token() (*oauth2.Token, error) {
+	token, err := h.ts.Token()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token, h.err, h.lastCheck = token, err, time.Now()
+	return token, err
+}
+
+// Check calls Token() to probe the wrapped source and returns its error.
+func (h *HealthCheckedTokenSource) Check() error {
+	_, err := h.Token()
+	return err
+}
+
+// Healthy reports whether the last Token() call succeeded and its token is still valid.
+// It is false before the first call.
+func (h *HealthCheckedTokenSource) Healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err == nil && h.token.Valid()
+}
+
+// LastCheck returns when Token() was called last. It is zero before the first call.
+func (h *HealthCheckedTokenSource) LastCheck() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastCheck
+}
+
+// LastError returns the error of the last Token() call.
+func (h *HealthCheckedTokenSource) LastError() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
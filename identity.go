@@ -0,0 +1,79 @@
+package tokensource
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Identity is the principal which the token is generated as.
+type Identity struct {
+	// TargetPrincipal is the impersonated service account. It is empty if impersonation is not active.
+	TargetPrincipal string
+	// Delegates is the delegate chain of the impersonation.
+	Delegates []string
+	// Email is the email of ADC if it is discoverable from the credentials file (e.g. service account key).
+	// It is empty for the metadata server and user credentials.
+	Email string
+}
+
+// String returns the effective principal, or "default" if it is not discoverable.
+func (i Identity) String() string {
+	switch {
+	case i.TargetPrincipal != "":
+		return i.TargetPrincipal
+	case i.Email != "":
+		return i.Email
+	default:
+		return "default"
+	}
+}
+
+// IdentityOf returns Identity of ts created by the smart token sources (e.g. SmartAccessTokenSource, SmartIDTokenSource).
+// The second value is false if ts doesn't carry Identity.
+func IdentityOf(ts oauth2.TokenSource) (Identity, bool) {
+	if sts, ok := ts.(*smartTokenSource); ok {
+		return sts.identity, true
+	}
+	return Identity{}, false
+}
+
+type identityKey struct{}
+
+// ContextWithIdentity returns ctx carrying id, e.g. for request logs.
+func ContextWithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns Identity carried by ctx by ContextWithIdentity.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// impersonatedIdentity returns Identity of the impersonation.
+func impersonatedIdentity(targetPrincipal string, delegates []string) Identity {
+	return Identity{TargetPrincipal: targetPrincipal, Delegates: delegates}
+}
+
+// credentialsIdentity discovers Identity from the credentials JSON file.
+func credentialsIdentity(b []byte) Identity {
+	var f struct {
+		ClientEmail                    string `json:"client_email"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if len(b) == 0 || json.Unmarshal(b, &f) != nil {
+		return Identity{}
+	}
+	if f.ClientEmail != "" {
+		return Identity{Email: f.ClientEmail}
+	}
+	// External accounts may impersonate .../serviceAccounts/EMAIL:generateAccessToken.
+	if i := strings.LastIndex(f.ServiceAccountImpersonationURL, "/serviceAccounts/"); i >= 0 {
+		email := f.ServiceAccountImpersonationURL[i+len("/serviceAccounts/"):]
+		return Identity{Email: strings.TrimSuffix(email, ":generateAccessToken")}
+	}
+	return Identity{}
+}
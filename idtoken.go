@@ -0,0 +1,91 @@
+package tokensource
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+// JWTHeader is the JOSE header of ID token.
+type JWTHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// ParseIDTokenHeader parses the header of the raw ID token without verification.
+// KeyID and Type are empty if they are absent.
+func ParseIDTokenHeader(raw string) (JWTHeader, error) {
+	var header JWTHeader
+	if err := decodeJWTSegment(raw, 0, &header); err != nil {
+		return JWTHeader{}, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	if header.Algorithm == "" {
+		return JWTHeader{}, errors.New("malformed ID token header: alg is missing")
+	}
+	return header, nil
+}
+
+// decodeJWTSegment decodes i-th segment of the compact serialized JWT into v.
+func decodeJWTSegment(raw string, i int, v interface{}) error {
+	segments := strings.Split(raw, ".")
+	if len(segments) != 3 {
+		return fmt.Errorf("JWT must have 3 segments, but got %d", len(segments))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[i], "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+type parsedIDExpiryTokenSource struct {
+	ts oauth2.TokenSource
+}
+
+// WithParsedIDExpiry wraps ts to populate Token.Expiry from the exp claim of the ID token if Expiry is zero.
+// The signature is not verified. Tokens which are not JWT are returned as is.
+// It makes MarginBeforeExpiry of AsyncTokenSource work reliably for ID tokens.
+func WithParsedIDExpiry(ts oauth2.TokenSource) oauth2.TokenSource {
+	return &parsedIDExpiryTokenSource{ts: ts}
+}
+
+func (s *parsedIDExpiryTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	if !token.Expiry.IsZero() {
+		return token, nil
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := decodeJWTSegment(token.AccessToken, 1, &claims); err != nil || claims.Exp == 0 {
+		return token, nil
+	}
+	token = cloneToken(token)
+	token.Expiry = time.Unix(claims.Exp, 0)
+	return token, nil
+}
+
+// VerifyIDToken verifies the signature, audience, issuer and expiry of the raw ID token and returns the parsed payload.
+// opts are passed to idtoken.NewValidator, e.g. option.WithHTTPClient to serve the keyset offline in tests.
+func VerifyIDToken(ctx context.Context, raw, audience string, opts ...option.ClientOption) (*idtoken.Payload, error) {
+	if len(opts) == 0 {
+		return idtoken.Validate(ctx, raw, audience)
+	}
+	validator, err := idtoken.NewValidator(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return validator.Validate(ctx, raw, audience)
+}
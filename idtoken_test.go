@@ -0,0 +1,42 @@
+package tokensource_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/apstndb/tokensource"
+)
+
+// jwt returns the compact serialized JWT with header and an empty payload. The signature is not valid.
+func jwt(header string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(header)) + "." + enc([]byte("{}")) + ".signature"
+}
+
+func TestParseIDTokenHeader(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		raw     string
+		want    tokensource.JWTHeader
+		wantErr bool
+	}{
+		{"with kid", jwt(`{"alg":"RS256","kid":"key-1","typ":"JWT"}`), tokensource.JWTHeader{Algorithm: "RS256", KeyID: "key-1", Type: "JWT"}, false},
+		{"without kid", jwt(`{"alg":"RS256","typ":"JWT"}`), tokensource.JWTHeader{Algorithm: "RS256", Type: "JWT"}, false},
+		{"padded", base64.URLEncoding.EncodeToString([]byte(`{"alg":"ES256"}`)) + ".e30.signature", tokensource.JWTHeader{Algorithm: "ES256"}, false},
+		{"without alg", jwt(`{"kid":"key-1"}`), tokensource.JWTHeader{}, true},
+		{"not JSON", jwt(`alg`), tokensource.JWTHeader{}, true},
+		{"not base64", "!!!.e30.signature", tokensource.JWTHeader{}, true},
+		{"2 segments", "e30.e30", tokensource.JWTHeader{}, true},
+		{"empty", "", tokensource.JWTHeader{}, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tokensource.ParseIDTokenHeader(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("want %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
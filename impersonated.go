@@ -0,0 +1,69 @@
+package tokensource
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// ImpersonatedAccessTokenSource generate oauth2.TokenSource which generates access token impersonating target with delegates.
+// Unlike SmartAccessTokenSource, CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is not read, so the identity can differ per tenant or request.
+func ImpersonatedAccessTokenSource(ctx context.Context, target string, delegates []string, scopes ...string) (oauth2.TokenSource, error) {
+	ts, err := impersonatedAccessTokenSource(ctx, Constructors{}, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Delegates:       delegates,
+		Scopes:          scopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// ImpersonatedIDTokenSource generate oauth2.TokenSource which generates ID token for audience impersonating target with delegates.
+// includeEmail should be true for Cloud IAP, which requires email claim.
+func ImpersonatedIDTokenSource(ctx context.Context, target string, delegates []string, audience string, includeEmail bool) (oauth2.TokenSource, error) {
+	ts, err := impersonatedIDTokenSource(ctx, Constructors{}, impersonate.IDTokenConfig{
+		Audience:        audience,
+		TargetPrincipal: target,
+		Delegates:       delegates,
+		IncludeEmail:    includeEmail,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func impersonatedAccessTokenSource(ctx context.Context, constructors Constructors, config impersonate.CredentialsConfig, opts ...option.ClientOption) (*smartTokenSource, error) {
+	if err := validateImpersonation(config.TargetPrincipal, config.Delegates); err != nil {
+		return nil, err
+	}
+	ts, err := constructors.impersonatedCredentials(ctx, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &smartTokenSource{TokenSource: ts, identity: impersonatedIdentity(config.TargetPrincipal, config.Delegates)}, nil
+}
+
+func impersonatedIDTokenSource(ctx context.Context, constructors Constructors, config impersonate.IDTokenConfig, opts ...option.ClientOption) (*smartTokenSource, error) {
+	if err := validateImpersonation(config.TargetPrincipal, config.Delegates); err != nil {
+		return nil, err
+	}
+	ts, err := constructors.impersonatedIDToken(ctx, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &smartTokenSource{TokenSource: ts, identity: impersonatedIdentity(config.TargetPrincipal, config.Delegates)}, nil
+}
+
+// validateImpersonation returns an error if target is invalid or delegates exceed MaxDelegateHops.
+func validateImpersonation(target string, delegates []string) error {
+	if err := validatePrincipal(target); err != nil {
+		return fmt.Errorf("target principal %w", err)
+	}
+	return checkDelegateHops(delegates)
+}
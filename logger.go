@@ -0,0 +1,54 @@
+package tokensource
+
+import "time"
+
+// Logger is the logger used by AsyncTokenSource.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger is the default Logger which discards all logs.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// Stable messages of RefreshEvent.
+const (
+	EventRefreshStarted   = "refresh started"
+	EventRefreshSucceeded = "refresh succeeded"
+	EventRefreshRetrying  = "refresh failed, retrying"
+	EventRefreshFailed    = "refresh failed"
+	EventRefreshGaveUp    = "giving up after backoff exhausted"
+)
+
+// RefreshEvent is a lifecycle event of token refreshing.
+type RefreshEvent struct {
+	// Message is one of the stable messages like EventRefreshStarted.
+	Message string
+	// Attempt is the number of attempts in the refresh. It is zero for EventRefreshStarted.
+	Attempt int
+	// Elapsed is the elapsed time since the refresh started.
+	Elapsed time.Duration
+	// Expiry is the expiry of the new token. It is set only for EventRefreshSucceeded.
+	Expiry time.Time
+	// Err is the error of the last attempt.
+	Err error
+}
+
+// RefreshEventLogger is the optional interface of Logger to receive RefreshEvent as structured data.
+// If Logger doesn't implement it, RefreshEvent is logged by Logger.Debugf.
+type RefreshEventLogger interface {
+	LogRefreshEvent(e RefreshEvent)
+}
+
+func (ts *AsyncTokenSource) logEvent(e RefreshEvent) {
+	if l, ok := ts.conf.Logger.(RefreshEventLogger); ok {
+		l.LogRefreshEvent(e)
+		return
+	}
+	ts.conf.Logger.Debugf("AsyncRefreshingTokenSource: %s, attempt: %d, elapsed: %v, expiry: %v, error: %v", e.Message, e.Attempt, e.Elapsed, e.Expiry, e.Err)
+}
@@ -0,0 +1,186 @@
+package tokensource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// MultiAudienceIDTokenSource provides ID tokens of the same identity for multiple audiences
+// with one AsyncTokenSource, so all audiences share one refresh loop and are refreshed together.
+type MultiAudienceIDTokenSource struct {
+	ts     *AsyncTokenSource
+	tokens *audienceTokens
+}
+
+// NewMultiAudienceIDTokenSource create MultiAudienceIDTokenSource generating ID tokens like SmartIDTokenSource for audiences.
+// The refresh is scheduled by the earliest Expiry among the audiences.
+func NewMultiAudienceIDTokenSource(ctx context.Context, audiences []string, opts ...Option) (*MultiAudienceIDTokenSource, error) {
+	return NewMultiAudienceIDTokenSourceWithOptions(ctx, audiences, IDOptions{}, opts...)
+}
+
+// NewMultiAudienceIDTokenSourceWithOptions is NewMultiAudienceIDTokenSource generating ID tokens like SmartIDTokenSourceWithOptions with idOpts.
+// The identity is resolved once from CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT or ADC, and shared by all audiences.
+// A failure of some audiences doesn't fail the others: TokenFor returns the error only for the failed audience,
+// or its last token while it is still valid. The refresh fails only if all audiences fail.
+func NewMultiAudienceIDTokenSourceWithOptions(ctx context.Context, audiences []string, idOpts IDOptions, opts ...Option) (*MultiAudienceIDTokenSource, error) {
+	if len(audiences) == 0 {
+		return nil, errors.New("MultiAudienceIDTokenSource: no audience is given")
+	}
+	audiences = append([]string(nil), audiences...)
+	newSource, err := resolveIDTokenIdentity(ctx, idOpts)
+	if err != nil {
+		return nil, err
+	}
+	tokens := &audienceTokens{tokens: make(map[string]*oauth2.Token), errs: make(map[string]error)}
+	ts, err := NewAsyncRefreshingTokenSourceWithOptions(ctx, func(ctx context.Context) (oauth2.TokenSource, error) {
+		return &multiAudienceTokenSource{ctx: ctx, audiences: audiences, newSource: newSource, tokens: tokens}, nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiAudienceIDTokenSource{ts: ts, tokens: tokens}, nil
+}
+
+// resolveIDTokenIdentity resolves the identity like SmartIDTokenSourceWithOptions,
+// and returns the function to generate the ID token source of each audience with it.
+func resolveIDTokenIdentity(ctx context.Context, opts IDOptions) (func(ctx context.Context, audience string) (oauth2.TokenSource, error), error) {
+	if impSaVal := os.Getenv(impSaEnvName); impSaVal != "" {
+		targetPrincipal, delegates, err := ParseDelegateChainE(impSaVal)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+			return impersonatedIDTokenSource(ctx, opts.Constructors, impersonate.IDTokenConfig{
+				Audience:        audience,
+				TargetPrincipal: targetPrincipal,
+				Delegates:       delegates,
+				IncludeEmail:    !opts.OmitEmail,
+			}, opts.ClientOptions...)
+		}, nil
+	}
+
+	clientOpts := opts.ClientOptions
+	if len(clientOpts) == 0 {
+		// Find ADC once instead of for each audience. Without JSON, the metadata server is used for each audience.
+		creds, err := opts.Constructors.findDefaultCredentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(creds.JSON) > 0 {
+			clientOpts = []option.ClientOption{option.WithCredentialsJSON(creds.JSON)}
+		}
+	}
+	return func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+		return opts.Constructors.idToken(ctx, audience, clientOpts...)
+	}, nil
+}
+
+// TokenFor returns the ID token for audience. audience must be one of the audiences given to NewMultiAudienceIDTokenSource.
+func (m *MultiAudienceIDTokenSource) TokenFor(audience string) (*oauth2.Token, error) {
+	if _, err := m.ts.Token(); err != nil {
+		return nil, err
+	}
+	return m.tokens.tokenFor(audience)
+}
+
+// TokenSourceFor returns oauth2.TokenSource which returns the ID token for audience.
+func (m *MultiAudienceIDTokenSource) TokenSourceFor(audience string) oauth2.TokenSource {
+	return audienceTokenSource{m: m, audience: audience}
+}
+
+// ForceRefresh refreshes the tokens of all audiences immediately like AsyncTokenSource.ForceRefresh.
+func (m *MultiAudienceIDTokenSource) ForceRefresh(ctx context.Context) error {
+	_, err := m.ts.ForceRefresh(ctx)
+	return err
+}
+
+// Close stops the background refresh.
+func (m *MultiAudienceIDTokenSource) Close() error {
+	return m.ts.Close()
+}
+
+type audienceTokenSource struct {
+	m        *MultiAudienceIDTokenSource
+	audience string
+}
+
+func (s audienceTokenSource) Token() (*oauth2.Token, error) {
+	return s.m.TokenFor(s.audience)
+}
+
+// audienceTokens are the last token and the last error of each audience, shared across refreshes.
+type audienceTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+	errs   map[string]error
+}
+
+func (a *audienceTokens) tokenFor(audience string) (*oauth2.Token, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if token, ok := a.tokens[audience]; ok && token.Valid() {
+		return cloneToken(token), nil
+	}
+	if err, ok := a.errs[audience]; ok {
+		return nil, fmt.Errorf("audience %q: %w", audience, err)
+	}
+	return nil, fmt.Errorf("MultiAudienceIDTokenSource: unknown audience %q", audience)
+}
+
+// multiAudienceTokenSource fetches the tokens of all audiences into audienceTokens.
+// It returns a token whose Expiry is the earliest one among the audiences to schedule the next refresh.
+type multiAudienceTokenSource struct {
+	ctx       context.Context
+	audiences []string
+	newSource func(ctx context.Context, audience string) (oauth2.TokenSource, error)
+	tokens    *audienceTokens
+}
+
+func (s *multiAudienceTokenSource) Token() (*oauth2.Token, error) {
+	var combined oauth2.Token
+	var errs []string
+	for _, audience := range s.audiences {
+		token, err := s.token(audience)
+		s.tokens.mu.Lock()
+		if err != nil {
+			s.tokens.errs[audience] = err
+			errs = append(errs, fmt.Sprintf("audience %q: %v", audience, err))
+			// The last token is kept while it is valid, and its Expiry brings the next refresh forward.
+			token = s.tokens.tokens[audience]
+		} else {
+			s.tokens.tokens[audience] = token
+			delete(s.tokens.errs, audience)
+		}
+		s.tokens.mu.Unlock()
+		if !token.Valid() {
+			continue
+		}
+		if combined.AccessToken == "" {
+			// AccessToken is required for Token.Valid.
+			combined.AccessToken, combined.TokenType = token.AccessToken, token.TokenType
+		}
+		if !token.Expiry.IsZero() && (combined.Expiry.IsZero() || token.Expiry.Before(combined.Expiry)) {
+			combined.Expiry = token.Expiry
+		}
+	}
+	if len(errs) == len(s.audiences) {
+		return nil, fmt.Errorf("MultiAudienceIDTokenSource: all audiences failed: %s", strings.Join(errs, "; "))
+	}
+	return &combined, nil
+}
+
+func (s *multiAudienceTokenSource) token(audience string) (*oauth2.Token, error) {
+	source, err := s.newSource(s.ctx, audience)
+	if err != nil {
+		return nil, err
+	}
+	return source.Token()
+}
@@ -0,0 +1,113 @@
+package tokensource_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+
+	"github.com/apstndb/tokensource"
+	"github.com/apstndb/tokensource/tokensourcetest"
+)
+
+func TestMultiAudienceIDTokenSource_SharesIdentityAndSeparatesErrors(t *testing.T) {
+	if os.Getenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT") != "" {
+		t.Skip("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is set")
+	}
+	var mu sync.Mutex
+	var findCalls int
+	var gotOptions []int
+	failing := map[string]bool{"https://bad.example.com": true}
+	idOpts := tokensource.IDOptions{
+		Constructors: tokensource.Constructors{
+			FindDefaultCredentials: func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+				mu.Lock()
+				findCalls++
+				mu.Unlock()
+				return &google.Credentials{JSON: []byte(`{"type":"service_account"}`)}, nil
+			},
+			IDToken: func(ctx context.Context, audience string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				gotOptions = append(gotOptions, len(opts))
+				if failing[audience] {
+					return tokensourcetest.NewFakeTokenSource(tokensourcetest.ErrorResponse(errors.New("permission denied"))), nil
+				}
+				return tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse(audience, time.Now().Add(time.Hour))), nil
+			},
+		},
+	}
+	audiences := []string{"https://a.example.com", "https://bad.example.com", "https://b.example.com"}
+	ts, err := tokensource.NewMultiAudienceIDTokenSourceWithOptions(context.Background(), audiences, idOpts, tokensource.WithConfig(tokensource.AsyncRefreshingConfig{MinForceRefreshInterval: -1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	for _, audience := range []string{"https://a.example.com", "https://b.example.com"} {
+		token, err := ts.TokenFor(audience)
+		if err != nil {
+			t.Fatalf("%s: %v", audience, err)
+		}
+		if token.AccessToken != audience {
+			t.Errorf("%s: want the token for the audience, got %q", audience, token.AccessToken)
+		}
+	}
+	if _, err := ts.TokenFor("https://bad.example.com"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("want the error of the failing audience, got %v", err)
+	}
+	if _, err := ts.TokenFor("https://unknown.example.com"); err == nil {
+		t.Error("want an error for the unknown audience")
+	}
+
+	// The identity is kept across refreshes, and the last token is served while the audience fails.
+	mu.Lock()
+	failing["https://a.example.com"] = true
+	mu.Unlock()
+	if err := ts.ForceRefresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := ts.TokenFor("https://a.example.com"); err != nil || token.AccessToken != "https://a.example.com" {
+		t.Errorf("want the last token of the failing audience, got %v, %v", token, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if findCalls != 1 {
+		t.Errorf("FindDefaultCredentials: want 1 call, got %d", findCalls)
+	}
+	if len(gotOptions) != 2*len(audiences) {
+		t.Errorf("IDToken: want %d calls, got %d", 2*len(audiences), len(gotOptions))
+	}
+	for _, n := range gotOptions {
+		if n != 1 {
+			t.Errorf("IDToken: want the credentials JSON as the only ClientOption, got %d options", n)
+		}
+	}
+}
+
+func TestMultiAudienceIDTokenSource_AllAudiencesFail(t *testing.T) {
+	if os.Getenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT") != "" {
+		t.Skip("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is set")
+	}
+	idOpts := tokensource.IDOptions{
+		ClientOptions: []option.ClientOption{option.WithEndpoint("https://example.com")},
+		Constructors: tokensource.Constructors{
+			IDToken: func(ctx context.Context, audience string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+				return nil, errors.New("no credentials")
+			},
+		},
+	}
+	// The initial refresh fails only if all audiences fail.
+	_, err := tokensource.NewMultiAudienceIDTokenSourceWithOptions(context.Background(), []string{"https://a.example.com", "https://b.example.com"}, idOpts)
+	if err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("want the error of all audiences, got %v", err)
+	}
+}
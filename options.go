@@ -0,0 +1,86 @@
+package tokensource
+
+import (
+	"context"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// Option configures AsyncTokenSource in NewAsyncRefreshingTokenSourceWithOptions.
+type Option func(conf *AsyncRefreshingConfig)
+
+// WithConfig replaces the whole configuration with conf. Options after it override the fields of conf.
+func WithConfig(conf AsyncRefreshingConfig) Option {
+	return func(c *AsyncRefreshingConfig) {
+		*c = conf
+	}
+}
+
+// WithRefreshInterval sets AsyncRefreshingConfig.RefreshInterval. Default: DefaultRefreshInterval.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.RefreshInterval = d
+	}
+}
+
+// WithMarginBeforeExpiry sets AsyncRefreshingConfig.MarginBeforeExpiry. Default: Expiry is not cared.
+func WithMarginBeforeExpiry(d time.Duration) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.MarginBeforeExpiry = d
+	}
+}
+
+// WithBackoff sets AsyncRefreshingConfig.Backoff.
+//
+// Deprecated: Use WithNewBackoff.
+func WithBackoff(b backoff.BackOff) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.Backoff = b
+	}
+}
+
+// WithNewBackoff sets AsyncRefreshingConfig.NewBackoff. Default: backoff.NewExponentialBackOff(). Use NoBackoff to disable retries.
+func WithNewBackoff(f func() backoff.BackOff) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.NewBackoff = f
+	}
+}
+
+// WithSyncRetryJitter sets AsyncRefreshingConfig.SyncRetryJitterFactor. Default: no additional jitter.
+func WithSyncRetryJitter(randomizationFactor float64) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.SyncRetryJitterFactor = randomizationFactor
+	}
+}
+
+// WithRetryable sets AsyncRefreshingConfig.IsRetryable. Default: never retry.
+func WithRetryable(isRetryable func(err error) bool) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.IsRetryable = isRetryable
+	}
+}
+
+// WithLogger sets AsyncRefreshingConfig.Logger. Default: logs are discarded.
+func WithLogger(logger Logger) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.Logger = logger
+	}
+}
+
+// WithCircuitBreaker sets AsyncRefreshingConfig.CircuitBreakerThreshold and CircuitBreakerCooldown. Default: disabled.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.CircuitBreakerThreshold = threshold
+		c.CircuitBreakerCooldown = cooldown
+	}
+}
+
+// WithRefreshTimeout sets AsyncRefreshingConfig.RefreshContext to limit each refresh by timeout. Default: no timeout.
+func WithRefreshTimeout(timeout time.Duration) Option {
+	return func(c *AsyncRefreshingConfig) {
+		c.RefreshContext = func(ctx context.Context) (context.Context, context.CancelFunc) {
+			return context.WithTimeout(ctx, timeout)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/apstndb/tokensource/otel
+
+go 1.16
+
+require (
+	github.com/apstndb/tokensource v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+)
+
+replace github.com/apstndb/tokensource => ../
@@ -0,0 +1,45 @@
+// Package otel provides OpenTelemetry tracing for tokensource.AsyncTokenSource.
+// It is a separate module, so the core module doesn't depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/apstndb/tokensource"
+)
+
+const (
+	instrumentationName = "github.com/apstndb/tokensource/otel"
+	spanName            = "tokensource.Refresh"
+)
+
+type tracer struct {
+	tracer trace.Tracer
+	kind   string
+}
+
+// NewTracer returns tokensource.RefreshTracer which starts a span named tokensource.Refresh for each refresh.
+// kind describes the kind of the token (e.g. "access_token" for scopes, "id_token" for audience) and is recorded as an attribute.
+// Set it to AsyncRefreshingConfig.Tracer.
+func NewTracer(tp trace.TracerProvider, kind string) tokensource.RefreshTracer {
+	return &tracer{tracer: tp.Tracer(instrumentationName), kind: kind}
+}
+
+func (t *tracer) StartRefresh(ctx context.Context, trigger tokensource.RefreshTrigger) (context.Context, func(err error)) {
+	ctx, span := t.tracer.Start(ctx, spanName, trace.WithAttributes(
+		attribute.String("tokensource.kind", t.kind),
+		attribute.String("tokensource.trigger", string(trigger)),
+		attribute.Bool("tokensource.background", trigger == tokensource.TriggerBackground),
+	))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
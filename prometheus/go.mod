@@ -0,0 +1,10 @@
+module github.com/apstndb/tokensource/prometheus
+
+go 1.16
+
+require (
+	github.com/apstndb/tokensource v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.10.0
+)
+
+replace github.com/apstndb/tokensource => ../
@@ -0,0 +1,55 @@
+// Package prometheus provides prometheus.Collector for tokensource.AsyncTokenSource.
+// It is a separate module, so the core module doesn't depend on the Prometheus client.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/apstndb/tokensource"
+)
+
+type collector struct {
+	ts *tokensource.AsyncTokenSource
+
+	secondsUntilExpiry  *prometheus.Desc
+	refreshTotal        *prometheus.Desc
+	refreshDuration     *prometheus.Desc
+	consecutiveFailures *prometheus.Desc
+	expiredServed       *prometheus.Desc
+}
+
+// NewCollector returns prometheus.Collector which exports the refresh metrics of ts.
+// constLabels distinguish the token sources if multiple collectors are registered to the same registry (e.g. prometheus.Labels{"name": "spanner"}).
+func NewCollector(ts *tokensource.AsyncTokenSource, constLabels prometheus.Labels) prometheus.Collector {
+	return &collector{
+		ts:                  ts,
+		secondsUntilExpiry:  prometheus.NewDesc("token_seconds_until_expiry", "Seconds until the cached token expires.", nil, constLabels),
+		refreshTotal:        prometheus.NewDesc("token_refresh_total", "Number of token fetches including the first one, by result.", []string{"result"}, constLabels),
+		refreshDuration:     prometheus.NewDesc("token_refresh_duration_seconds", "Duration of the last refresh in seconds.", nil, constLabels),
+		consecutiveFailures: prometheus.NewDesc("token_consecutive_failures", "Number of failed token fetches since the last success.", nil, constLabels),
+		expiredServed:       prometheus.NewDesc("token_expired_served_total", "Number of tokens served which oauth2 considers expired.", nil, constLabels),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.secondsUntilExpiry
+	ch <- c.refreshTotal
+	ch <- c.refreshDuration
+	ch <- c.consecutiveFailures
+	ch <- c.expiredServed
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.ts.Stats()
+	// Tokens without Expiry never expire, so the gauge is omitted.
+	if expiry := c.ts.Expiry(); !expiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.secondsUntilExpiry, prometheus.GaugeValue, time.Until(expiry).Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(c.refreshTotal, prometheus.CounterValue, float64(stats.Successes), "success")
+	ch <- prometheus.MustNewConstMetric(c.refreshTotal, prometheus.CounterValue, float64(stats.Failures), "failure")
+	ch <- prometheus.MustNewConstMetric(c.refreshDuration, prometheus.GaugeValue, stats.LastRefreshDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.consecutiveFailures, prometheus.GaugeValue, float64(stats.ConsecutiveFailures))
+	ch <- prometheus.MustNewConstMetric(c.expiredServed, prometheus.CounterValue, float64(stats.ExpiredServed))
+}
@@ -2,173 +2,1259 @@ package tokensource
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"math/rand"
-	"os"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
-const defaultInterval = 30 * time.Minute
+// DefaultRefreshInterval is used when AsyncRefreshingConfig.RefreshInterval is not set.
+// It is read when the token source is created, so change it before creating token sources (e.g. in init).
+var DefaultRefreshInterval = 30 * time.Minute
 
-type asyncRefreshingTokenSource struct {
+// shortIntervalRatio is the ratio of the token lifetime to RefreshInterval regarded as too frequent refreshing.
+const shortIntervalRatio = 4
+
+// AsyncTokenSource is oauth2.TokenSource which refreshes the token asynchronously.
+// Use NewAsyncRefreshingTokenSource to create it.
+type AsyncTokenSource struct {
+	// genFunc is guarded by mu because it can be replaced by SetGenerator.
 	genFunc func(ctx context.Context) (oauth2.TokenSource, error)
 	token   *oauth2.Token
+	// current is the copy of token for the lock-free read in Token(). It stores nil *oauth2.Token after Close.
+	current atomic.Value
 	conf    AsyncRefreshingConfig
 	mu      sync.Mutex
-	// ctx is stored because genFunc use context.Context but TokenSource.Token() doesn't take context.Context.
+	// group collapses concurrent synchronous refreshes.
+	group singleflight.Group
+	stats Stats
+	// lastRefresh, lastErr and nextRefresh are the runtime state for observability.
+	lastRefresh time.Time
+	lastErr     error
+	nextRefresh time.Time
+	// createdAt is used to determine the warm-up period.
+	createdAt time.Time
+	// ctx bounds the lifetime of the background refresh loop.
 	ctx context.Context
+	// valueCtx is used by Token() because genFunc use context.Context but TokenSource.Token() doesn't take context.Context.
+	valueCtx context.Context
+	// sharedCtx runs the synchronous refreshes shared by the callers. It carries the values of valueCtx,
+	// and it is cancelled only by Close, not by the callers nor the context passed to the constructor.
+	sharedCtx context.Context
+	// cancel stops the background refresh loop and cancels sharedCtx.
+	cancel context.CancelFunc
+	closed bool
+	// readyC is closed when the first token is fetched.
+	readyC    chan struct{}
+	readyOnce sync.Once
+	// startOnce ensures the background loop is started once.
+	startOnce sync.Once
+	// stopC stops the background loop without cancelling the in-flight refresh, and loopDone is closed when it has stopped.
+	stopC    chan struct{}
+	stopOnce sync.Once
+	loopDone chan struct{}
+	// stopping is set by Shutdown, and inflight counts the synchronous refreshes for Shutdown to wait for.
+	stopping bool
+	inflight sync.WaitGroup
+	// resetC notifies the background loop that ForceRefresh has refreshed the token.
+	resetC chan struct{}
+	// source is the generated TokenSource cached with ReuseGeneratedTokenSource.
+	source oauth2.TokenSource
+	// lastForced and lastForcedErr are the result of the last forced refresh for MinForceRefreshInterval.
+	lastForced    time.Time
+	lastForcedErr error
+	// randMu serializes the calls of RandFloat64.
+	randMu sync.Mutex
+	// subscribers are the channels returned by Subscribe.
+	subscribers map[<-chan TokenEvent]chan TokenEvent
+	// circuitOpenUntil is the end of the cool-down of the circuit breaker opened by CircuitBreakerThreshold.
+	circuitOpenUntil time.Time
+}
+
+// DefaultMinRefreshWait is used when AsyncRefreshingConfig.MinRefreshWait is not set.
+var DefaultMinRefreshWait = 10 * time.Second
+
+// DefaultMinForceRefreshInterval is used when AsyncRefreshingConfig.MinForceRefreshInterval is not set.
+var DefaultMinForceRefreshInterval = 5 * time.Second
+
+// DefaultCircuitBreakerCooldown is used when AsyncRefreshingConfig.CircuitBreakerThreshold is set but CircuitBreakerCooldown is not.
+var DefaultCircuitBreakerCooldown = 30 * time.Second
+
+// ForceRefresh refreshes the token immediately, regardless of the validity of the cached token.
+// The next background refresh is rescheduled from now.
+// It is useful when the credential is known to be rotated or revoked.
+// Concurrent calls share one refresh, and calls within MinForceRefreshInterval after the last forced refresh
+// return its result without refreshing, to protect the token endpoint from bursts (e.g. 401 responses).
+// Like TokenContext, ctx only bounds the wait for the shared refresh.
+func (ts *AsyncTokenSource) ForceRefresh(ctx context.Context) (*oauth2.Token, error) {
+	return ts.forceRefresh(ctx, true)
 }
 
-func (ts *asyncRefreshingTokenSource) Token() (*oauth2.Token, error) {
+func (ts *AsyncTokenSource) forceRefresh(ctx context.Context, rateLimited bool) (*oauth2.Token, error) {
+	if _, _, err := ts.validToken(); err != nil {
+		return nil, err
+	}
+	if !rateLimited {
+		if !ts.beginRefresh() {
+			return nil, ErrClosed
+		}
+		defer ts.inflight.Done()
+		// Close aborts the refresh like the shared ones, though it runs with ctx of the caller.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ts.sharedCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		return ts.doForceRefresh(ctx)
+	}
+	return ts.shared(ctx, "force", func(ctx context.Context) (*oauth2.Token, error) {
+		ts.mu.Lock()
+		if !ts.lastForced.IsZero() && ts.conf.Clock.Now().Sub(ts.lastForced) < ts.conf.MinForceRefreshInterval {
+			token, err := cloneToken(ts.token), ts.lastForcedErr
+			ts.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return token, nil
+		}
+		ts.mu.Unlock()
+		return ts.doForceRefresh(ctx)
+	})
+}
+
+// shared runs refresh once among the concurrent callers with the same key, and waits for its result until ctx is done.
+// refresh runs with sharedCtx instead of ctx, so a cancelled caller doesn't fail the other callers sharing the refresh,
+// but Close aborts it. Use RefreshContext to bound the refresh itself.
+func (ts *AsyncTokenSource) shared(ctx context.Context, key string, refresh func(ctx context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	resultC := ts.group.DoChan(key, func() (interface{}, error) {
+		if !ts.beginRefresh() {
+			return nil, ErrClosed
+		}
+		defer ts.inflight.Done()
+		return refresh(ts.sharedCtx)
+	})
+	select {
+	case r := <-resultC:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return cloneToken(r.Val.(*oauth2.Token)), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// beginRefresh registers a synchronous refresh to be waited by Shutdown, which must call inflight.Done after the refresh.
+// It returns false once Shutdown or Close is called, and then the refresh must not start.
+func (ts *AsyncTokenSource) beginRefresh() bool {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
-	if ts.token.Valid() {
-		return ts.token, nil
+	if ts.closed || ts.stopping {
+		return false
 	}
-	tokenSource, err := ts.genFunc(ts.ctx)
+	ts.inflight.Add(1)
+	return true
+}
+
+func (ts *AsyncTokenSource) doForceRefresh(ctx context.Context) (*oauth2.Token, error) {
+	trigger := ts.triggerOr(TriggerForced)
+	begin := ts.conf.Clock.Now()
+	_, err := ts.flip(ctx, trigger)
+	ts.mu.Lock()
+	ts.recordFetchLocked(trigger, ts.conf.Clock.Now().Sub(begin))
+	ts.lastForced, ts.lastForcedErr = ts.conf.Clock.Now(), err
+	token := cloneToken(ts.token)
+	ts.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	token, err := tokenSource.Token()
-	// Don't perform exponential backoff because this method doesn't take current context.
+	ts.startLoop(token.Expiry)
+	select {
+	case ts.resetC <- struct{}{}:
+	default:
+		// The background loop has already been notified.
+	}
+	return token, nil
+}
+
+// SetGenerator replaces genFunc and refreshes the token immediately with it using ctx, e.g. after reloading the credential configuration.
+// It is safe to call concurrently with Token() and the background refresh. If the refresh fails, the last token is kept
+// and the error is returned, but later refreshes use the new genFunc.
+func (ts *AsyncTokenSource) SetGenerator(ctx context.Context, genFunc func(ctx context.Context) (oauth2.TokenSource, error)) error {
+	ts.mu.Lock()
+	ts.genFunc = genFunc
+	ts.source = nil
+	ts.mu.Unlock()
+	// The new genFunc must be used even within MinForceRefreshInterval.
+	_, err := ts.forceRefresh(ctx, false)
+	return err
+}
+
+// ErrClosed is returned by Token() after AsyncTokenSource is closed.
+var ErrClosed = errors.New("AsyncRefreshingTokenSource is closed")
+
+// ErrPanicked is wrapped by the error returned when genFunc or the generated TokenSource panics.
+var ErrPanicked = errors.New("panic while refreshing token")
+
+// Shutdown stops the background refresh like Close, but waits for the in-flight refreshes to complete first,
+// both the background one and the synchronous ones by Token(), ForceRefresh and SetGenerator, so no refresh outlives the teardown.
+// If ctx is done before that, the refreshes are cancelled and the error wrapping ctx.Err() is returned.
+// Token() keeps serving the cached token while waiting, but no new refresh starts and ErrClosed is returned instead.
+func (ts *AsyncTokenSource) Shutdown(ctx context.Context) error {
+	ts.mu.Lock()
+	// beginRefresh checks stopping with ts.mu, so no refresh is added to inflight after Wait starts.
+	ts.stopping = true
+	ts.mu.Unlock()
+	ts.stopOnce.Do(func() { close(ts.stopC) })
+	// Prevent the loop from starting later, e.g. by Token() with LazyInit.
+	ts.startOnce.Do(func() { close(ts.loopDone) })
+	doneC := make(chan struct{})
+	go func() {
+		<-ts.loopDone
+		ts.inflight.Wait()
+		close(doneC)
+	}()
+	var err error
+	select {
+	case <-doneC:
+	case <-ctx.Done():
+		err = fmt.Errorf("AsyncRefreshingTokenSource: shutdown before the in-flight refresh completes: %w", ctx.Err())
+	}
+	ts.Close()
+	return err
+}
+
+// Close stops the background refresh. Token() returns ErrClosed after Close is called.
+// It is safe to call Close multiple times and concurrently with Token().
+func (ts *AsyncTokenSource) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.closed = true
+	ts.current.Store((*oauth2.Token)(nil))
+	ts.cancel()
+	ts.closeSubscribersLocked()
+	return nil
+}
+
+// Token implements oauth2.TokenSource.
+// It is equivalent to TokenContext with the values (e.g. oauth2.HTTPClient) of the context passed to NewAsyncRefreshingTokenSource,
+// but it is not cancelled with the context.
+func (ts *AsyncTokenSource) Token() (*oauth2.Token, error) {
+	return ts.TokenContext(ts.valueCtx)
+}
+
+// TokenContext returns the cached token if it is valid.
+// Otherwise, it refreshes the token synchronously with the configured NewBackoff and IsRetryable.
+// The refresh is shared by the concurrent callers and runs with the values of the context given to the constructor,
+// so ctx only bounds the wait: if ctx is done first, ctx.Err() is returned while the refresh continues for the others.
+// Close aborts the refresh.
+func (ts *AsyncTokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	token, err := ts.cachedToken(ctx)
 	if err != nil {
 		return nil, err
 	}
+	// The circuit breaker serves the last token until Expiry, and a source may return a token about to expire,
+	// but oauth2.Token.Valid already rejects it within 10 seconds of Expiry.
+	if !token.Valid() {
+		ts.mu.Lock()
+		ts.stats.ExpiredServed++
+		ts.mu.Unlock()
+		ts.conf.Logger.Warnf("AsyncRefreshingTokenSource: serving the token which oauth2 considers expired (expiry: %v), refresh may be failing", token.Expiry)
+	}
+	if ts.conf.ValidateToken != nil && ts.conf.Clock.Now().Sub(ts.createdAt) < ts.conf.WarmUpPeriod {
+		if err := ts.conf.ValidateToken(ctx, token); err != nil {
+			return nil, err
+		}
+	}
+	if ts.conf.RemainingLifetimeC != nil && !token.Expiry.IsZero() {
+		// Don't block Token() if the receiver is slow.
+		select {
+		case ts.conf.RemainingLifetimeC <- token.Expiry.Sub(ts.conf.Clock.Now()):
+		default:
+		}
+	}
+	return token, nil
+}
+
+// cachedToken returns the cached token if it is valid, otherwise it fetches a new token synchronously.
+// Concurrent synchronous refreshes are collapsed into one, and its result is shared by all callers.
+func (ts *AsyncTokenSource) cachedToken(ctx context.Context) (*oauth2.Token, error) {
+	if token, ok, err := ts.validToken(); ok || err != nil {
+		return token, err
+	}
+	if token, open, err := ts.circuitOpen(); open {
+		return token, err
+	}
+	return ts.shared(ctx, "token", func(ctx context.Context) (*oauth2.Token, error) {
+		// The token may have been refreshed while waiting.
+		if token, ok, err := ts.validToken(); ok || err != nil {
+			return token, err
+		}
+		trigger := ts.triggerOr(TriggerOnDemand)
+		begin := ts.conf.Clock.Now()
+		token, err := ts.retrieve(ctx, trigger)
+		elapsed := ts.conf.Clock.Now().Sub(begin)
+		ts.mu.Lock()
+		ts.recordFetchLocked(trigger, elapsed)
+		ts.recordResultLocked(err)
+		if err == nil {
+			ts.setTokenLocked(token)
+		}
+		ts.mu.Unlock()
+		ts.onRefresh(token, err, elapsed)
+		if err != nil {
+			return nil, err
+		}
+		// With LazyInit, the background loop starts after the first successful fetch.
+		ts.startLoop(token.Expiry)
+		return token, nil
+	})
+}
+
+// circuitOpen reports whether the circuit breaker is open.
+// While it is open, it returns the last token if it is not expired yet, otherwise *CircuitOpenError.
+func (ts *AsyncTokenSource) circuitOpen() (*oauth2.Token, bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := ts.conf.Clock.Now()
+	if !now.Before(ts.circuitOpenUntil) {
+		return nil, false, nil
+	}
+	if ts.token != nil && (ts.token.Expiry.IsZero() || now.Before(ts.token.Expiry)) {
+		return cloneToken(ts.token), true, nil
+	}
+	return nil, true, &CircuitOpenError{Err: ts.lastErr, Until: ts.circuitOpenUntil}
+}
+
+// setTokenLocked caches the newly fetched token. ts.mu must be held.
+func (ts *AsyncTokenSource) setTokenLocked(token *oauth2.Token) {
 	ts.token = token
-	return ts.token, nil
+	if !ts.closed {
+		ts.current.Store(token)
+	}
+	ts.readyOnce.Do(func() { close(ts.readyC) })
+	ts.publishLocked(token)
+}
+
+// WaitReady blocks until a token has been fetched successfully at least once.
+// If ctx is done before that, it returns the last refresh error, or ctx.Err() if no refresh has failed.
+// With eager initialization it returns immediately; with LazyInit it triggers the first fetch, shared with concurrent Token() calls,
+// and returns its error if it fails.
+func (ts *AsyncTokenSource) WaitReady(ctx context.Context) error {
+	if ts.conf.LazyInit {
+		select {
+		case <-ts.readyC:
+			return nil
+		default:
+		}
+		_, err := ts.cachedToken(ctx)
+		return err
+	}
+	select {
+	case <-ts.readyC:
+		return nil
+	case <-ctx.Done():
+		if err := ts.LastError(); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+}
+
+// validToken returns the copy of the cached token and true if it is valid.
+func (ts *AsyncTokenSource) validToken() (*oauth2.Token, bool, error) {
+	// Fast path without the lock for the common case. The stored token is never mutated.
+	if token, _ := ts.current.Load().(*oauth2.Token); token.Valid() {
+		return cloneToken(token), true, nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		return nil, false, ErrClosed
+	}
+	if ts.token.Valid() {
+		return cloneToken(ts.token), true, nil
+	}
+	return nil, false, nil
+}
+
+// fetch generates the TokenSource and fetches a token from it.
+// A panic in genFunc or the generated TokenSource is recovered and returned as an error wrapping ErrPanicked.
+func (ts *AsyncTokenSource) fetch(ctx context.Context, trigger RefreshTrigger) (token *oauth2.Token, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ts.conf.Logger.Errorf("AsyncRefreshingTokenSource: recovered from panic while refreshing token: %v\n%s", r, debug.Stack())
+			token, err = nil, fmt.Errorf("%w: %v", ErrPanicked, r)
+		}
+	}()
+	if ts.conf.Debug {
+		ctx = withDebugHTTPClient(ctx, ts.conf.Logger)
+	}
+	tokenSource, err := ts.tokenSource(ctx, trigger)
+	if err != nil {
+		return nil, err
+	}
+	token, err = tokenSource.Token()
+	if err != nil {
+		ts.dropTokenSource()
+		return nil, err
+	}
+	ts.checkScopes(token)
+	if ts.conf.NormalizeTokenType {
+		token = normalizeTokenType(token)
+	}
+	return token, nil
+}
+
+// normalizeTokenType returns the copy of token with TokenType "Bearer" if TokenType is empty or "bearer" in any case.
+// The token is copied because the generated TokenSource may cache it.
+func normalizeTokenType(token *oauth2.Token) *oauth2.Token {
+	if t := token.TokenType; t == "Bearer" || (t != "" && !strings.EqualFold(t, "Bearer")) {
+		return token
+	}
+	token = cloneToken(token)
+	token.TokenType = "Bearer"
+	return token
+}
+
+// tokenSource returns the cached TokenSource if ReuseGeneratedTokenSource is set, otherwise calls genFunc.
+func (ts *AsyncTokenSource) tokenSource(ctx context.Context, trigger RefreshTrigger) (oauth2.TokenSource, error) {
+	ts.mu.Lock()
+	genFunc, source := ts.genFunc, ts.source
+	ts.mu.Unlock()
+	if !ts.conf.ReuseGeneratedTokenSource {
+		return genFunc(ctx)
+	}
+	if source != nil && trigger != TriggerForced {
+		return source, nil
+	}
+	// The cached TokenSource outlives ctx of this refresh.
+	genCtx := ts.ctx
+	if ts.conf.Debug {
+		genCtx = withDebugHTTPClient(genCtx, ts.conf.Logger)
+	}
+	source, err := genFunc(genCtx)
+	if err != nil {
+		return nil, err
+	}
+	ts.mu.Lock()
+	ts.source = source
+	ts.mu.Unlock()
+	return source, nil
+}
+
+// dropTokenSource discards the cached TokenSource after it fails, so genFunc is called in the next refresh.
+func (ts *AsyncTokenSource) dropTokenSource() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.source = nil
+}
+
+// checkScopes logs a warning if the token is granted fewer scopes than ExpectedScopes.
+func (ts *AsyncTokenSource) checkScopes(token *oauth2.Token) {
+	granted := GrantedScopes(token)
+	if granted == nil {
+		return
+	}
+	ts.conf.Logger.Debugf("AsyncRefreshingTokenSource: token is refreshed with scopes %v", granted)
+	if missing := missingScopes(ts.conf.ExpectedScopes, granted); len(missing) > 0 {
+		ts.conf.Logger.Warnf("AsyncRefreshingTokenSource: token is not granted expected scopes %v", missing)
+	}
+}
+
+// GrantedScopes returns the scopes granted to the token from the scope field of the token response.
+// It returns nil if the token response doesn't have the scope field.
+func GrantedScopes(token *oauth2.Token) []string {
+	scope, ok := token.Extra("scope").(string)
+	if !ok {
+		return nil
+	}
+	return strings.Fields(scope)
+}
+
+func missingScopes(expected, granted []string) []string {
+	grantedSet := make(map[string]bool, len(granted))
+	for _, s := range granted {
+		grantedSet[s] = true
+	}
+	var missing []string
+	for _, s := range expected {
+		if !grantedSet[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// Expiry returns the expiry of the cached token without refreshing it.
+// It returns zero time if no token has been fetched yet.
+func (ts *AsyncTokenSource) Expiry() time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token == nil {
+		return time.Time{}
+	}
+	return ts.token.Expiry
+}
+
+// Valid reports whether the cached token is valid without refreshing it.
+// It returns false if no token has been fetched yet or ts is closed.
+func (ts *AsyncTokenSource) Valid() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return !ts.closed && ts.token.Valid()
+}
+
+// LastRefresh returns the time of the last successful refresh.
+func (ts *AsyncTokenSource) LastRefresh() time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.lastRefresh
+}
+
+// LastError returns the error of the last failed refresh, or nil if no refresh has failed.
+// It is useful for readiness probes because Token() may still serve the cached token.
+func (ts *AsyncTokenSource) LastError() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.lastErr
+}
+
+// Stats is the statistics of AsyncTokenSource.
+type Stats struct {
+	// InitialFetchDuration is the duration of the first token fetch in NewAsyncRefreshingTokenSource,
+	// or in the first Token(), ForceRefresh or WaitReady with LazyInit.
+	InitialFetchDuration time.Duration `json:"initial_fetch_duration"`
+	// Refreshes is the number of refreshes after the first token fetch, including failed ones.
+	Refreshes int64 `json:"refreshes"`
+	// LastRefreshDuration is the duration of the last refresh after the first token fetch.
+	LastRefreshDuration time.Duration `json:"last_refresh_duration"`
+	// Successes is the number of successful token fetches, including the first token fetch.
+	Successes int64 `json:"successes"`
+	// Failures is the number of failed token fetches, including the first token fetch.
+	Failures int64 `json:"failures"`
+	// ConsecutiveFailures is the number of failed token fetches since the last success.
+	ConsecutiveFailures int64 `json:"consecutive_failures"`
+	// ExpiredServed is the number of tokens served by Token() which oauth2.Token.Valid rejects,
+	// e.g. the last token served by the open circuit breaker within 10 seconds of Expiry.
+	ExpiredServed int64 `json:"expired_served"`
+}
+
+// Stats returns the current statistics of ts.
+func (ts *AsyncTokenSource) Stats() Stats {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.stats
+}
+
+// triggerOr returns TriggerInitial until the first token is fetched (e.g. with LazyInit), otherwise trigger.
+func (ts *AsyncTokenSource) triggerOr(trigger RefreshTrigger) RefreshTrigger {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token == nil {
+		return TriggerInitial
+	}
+	return trigger
+}
+
+// recordFetchLocked records the duration of a token fetch by trigger. ts.mu must be held.
+func (ts *AsyncTokenSource) recordFetchLocked(trigger RefreshTrigger, elapsed time.Duration) {
+	if trigger == TriggerInitial {
+		ts.stats.InitialFetchDuration = elapsed
+		return
+	}
+	ts.recordRefreshLocked(elapsed)
+}
+
+// recordRefreshLocked records a refresh after the first token fetch. ts.mu must be held.
+func (ts *AsyncTokenSource) recordRefreshLocked(elapsed time.Duration) {
+	ts.stats.Refreshes++
+	ts.stats.LastRefreshDuration = elapsed
 }
 
-// AsyncRefreshingConfig is the refresh configuration of AsyncRefreshingTokenSource.
+// recordResultLocked records the result of a token fetch. ts.mu must be held.
+func (ts *AsyncTokenSource) recordResultLocked(err error) {
+	if err != nil {
+		ts.lastErr = err
+		ts.stats.Failures++
+		ts.stats.ConsecutiveFailures++
+		if ts.conf.CircuitBreakerThreshold > 0 && ts.stats.ConsecutiveFailures >= int64(ts.conf.CircuitBreakerThreshold) {
+			ts.circuitOpenUntil = ts.conf.Clock.Now().Add(ts.conf.CircuitBreakerCooldown)
+		}
+		return
+	}
+	ts.lastRefresh = ts.conf.Clock.Now()
+	ts.stats.Successes++
+	ts.stats.ConsecutiveFailures = 0
+	ts.circuitOpenUntil = time.Time{}
+}
+
+// cloneToken returns a shallow copy of t so that callers can't mutate the cached token.
+// The copy shares the raw response (Token.Extra) with t but it is never mutated by oauth2.
+func cloneToken(t *oauth2.Token) *oauth2.Token {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// AsyncRefreshingConfig is the refresh configuration of AsyncTokenSource.
 type AsyncRefreshingConfig struct {
 	// MarginBeforeExpiry is the margin for refreshing the token before Expiry.
 	// If it is zero value, TokenSource don't care about Expiry.
 	MarginBeforeExpiry time.Duration
-	// RandomizationFactorForRefreshInterval is randomization factor for MarginBeforeExpiry.
+	// RandomizationFactorForMarginBeforeExpiry is randomization factor for MarginBeforeExpiry.
+	// The margin is randomized in [margin*(1-factor), margin*(1+factor)), the same distribution as RefreshInterval.
 	RandomizationFactorForMarginBeforeExpiry float64
+	// MarginJitterOneSided restricts the jitter of MarginBeforeExpiry to only enlarge the margin,
+	// so the refresh is never scheduled later than Expiry - MarginBeforeExpiry.
+	MarginJitterOneSided bool
 
 	// RefreshInterval is interval for refreshing token if Expiry based refreshing is not applied.
-	// If not set, 30 minutes is default interval.
+	// If the first token expires before the first interval, the first refresh is brought forward to the half of its remaining lifetime.
+	// If not set, DefaultRefreshInterval is used.
 	RefreshInterval time.Duration
 	// RandomizationFactorForRefreshInterval is randomization factor for RefreshInterval.
+	// The interval is randomized in [interval*(1-factor), interval*(1+factor)) both by the ticker and with CombineIntervalAndExpiry.
 	RandomizationFactorForRefreshInterval float64
 
+	// InitialJitterFactor brings the first background refresh forward by a random fraction in [0, InitialJitterFactor)
+	// of the wait, to de-synchronize a fleet of processes started at once. It must be in [0, 1).
+	InitialJitterFactor float64
+
+	// CombineIntervalAndExpiry makes TokenSource refresh at whichever of RefreshInterval or MarginBeforeExpiry comes first.
+	// If it is false, MarginBeforeExpiry overrides RefreshInterval: the interval based refresh is stopped
+	// while the Expiry based refreshing is applied, and resumes when a token without Expiry is fetched.
+	CombineIntervalAndExpiry bool
+
+	// PermanentWithoutExpiry makes TokenSource treat a token with zero Expiry as non-expiring.
+	// No periodic refresh is performed while such a token is cached except by MaxRefreshInterval, so it is refreshed only by ForceRefresh.
+	// It is useful for static or very long-lived credentials.
+	PermanentWithoutExpiry bool
+
+	// AutoExtendRefreshInterval extends RefreshInterval to the half of the lifetime of the first token
+	// if MarginBeforeExpiry is not set and RefreshInterval is much shorter than the lifetime.
+	// If it is false, only a warning is logged in that case.
+	AutoExtendRefreshInterval bool
+
 	// Backoff is backoff configuration for TokenSource.Token().
-	// If not set, backoff.NewExponentialBackOff is used as the default value.
-	// See also https://pkg.go.dev/github.com/cenkalti/backoff/v4#NewExponentialBackOff.
-	// If IsRetryable isn't set, no backoff will be performed.
+	// It is reset at the start of every refresh, so each refresh gets the full MaxElapsedTime budget.
+	// It is used only if NewBackoff is not set.
+	//
+	// Deprecated: The instance is shared by concurrent refreshes (e.g. ForceRefresh and the background refresh)
+	// while backoff.BackOff implementations are not safe for concurrent use. Use NewBackoff instead.
 	Backoff backoff.BackOff
 
+	// NewBackoff creates backoff configuration for each refresh.
+	// If neither NewBackoff nor Backoff is set, backoff.NewExponentialBackOff is used as the default value.
+	// See also https://pkg.go.dev/github.com/cenkalti/backoff/v4#NewExponentialBackOff.
+	// Set NoBackoff to disable retries explicitly.
+	// If IsRetryable isn't set, no backoff will be performed, and a warning is logged if NewBackoff or Backoff is set.
+	NewBackoff func() backoff.BackOff
+
+	// SyncRetryJitterFactor randomizes each retry wait of the synchronous refresh by Token() in
+	// [wait*(1-SyncRetryJitterFactor), wait*(1+SyncRetryJitterFactor)), on top of the randomization of the backoff itself.
+	// The default backoff is already randomized by 0.5, but a custom backoff may not be, and then the retries of
+	// the callers hitting the expired token at once are correlated. It must be in [0, 1).
+	SyncRetryJitterFactor float64
+
 	// IsRetryable is the predicate function for retryable errors.
 	// Default: never retry.
 	IsRetryable func(err error) bool
+
+	// BeforeRefresh is called before each background refresh.
+	// If it returns non-nil error, the refresh is skipped and retried after RefreshInterval, or at the target time of MarginBeforeExpiry
+	// if it is sooner, but not sooner than MinRefreshWait.
+	// It is not treated as a failure of token fetching.
+	BeforeRefresh func(ctx context.Context) error
+
+	// RefreshContext derives the context of each refresh, both background and synchronous, from the context of the caller
+	// or the lifetime of TokenSource, e.g. to set a per-refresh timeout or to attach trace spans.
+	// The returned CancelFunc is called after the refresh. If not set, the context is used as is.
+	RefreshContext func(ctx context.Context) (context.Context, context.CancelFunc)
+
+	// OnRefresh is called after each refresh, both background and synchronous.
+	// newToken is nil if err is not nil. It is called without holding the lock of TokenSource.
+	OnRefresh func(newToken *oauth2.Token, err error, elapsed time.Duration)
+
+	// WarmUpPeriod is the period after the creation of TokenSource in which Token() calls ValidateToken before returning the token.
+	WarmUpPeriod time.Duration
+	// ValidateToken validates the token served during WarmUpPeriod (e.g. idtoken.Validate).
+	// If it returns non-nil error, Token() returns the error.
+	ValidateToken func(ctx context.Context, token *oauth2.Token) error
+
+	// NormalizeTokenType canonicalizes TokenType of the fetched tokens to "Bearer" if it is empty or "bearer" in other cases,
+	// for servers strictly checking the Authorization header. Other token types are kept as is.
+	NormalizeTokenType bool
+
+	// ExpectedScopes are the scopes which the token is expected to be granted.
+	// If the token response shows that some of them are not granted, a warning is logged.
+	ExpectedScopes []string
+
+	// RemainingLifetimeC receives the remaining lifetime of the token served by each Token() call.
+	// The value is dropped if the channel is not ready to receive, and it is not sent for tokens without Expiry.
+	RemainingLifetimeC chan<- time.Duration
+
+	// Tracer traces each refresh. See the otel subpackage for OpenTelemetry.
+	Tracer RefreshTracer
+
+	// LazyInit defers the first token fetch from the constructor to the first Token() call,
+	// and the background refresh starts after the first successful fetch.
+	// With LazyInit, the constructor never returns a token fetch error.
+	LazyInit bool
+
+	// ReuseGeneratedTokenSource makes TokenSource keep the TokenSource generated by genFunc across refreshes.
+	// genFunc is called again only after the cached TokenSource returns an error, or by ForceRefresh.
+	// genFunc is called with the context given to the constructor because the generated TokenSource outlives each refresh.
+	// If the generated TokenSource caches tokens (e.g. oauth2.ReuseTokenSource), refreshes return the cached token
+	// until it is about to expire, so MarginBeforeExpiry is not effective.
+	ReuseGeneratedTokenSource bool
+
+	// MaxRefreshInterval is the upper bound of the time between background refreshes if it is set.
+	// It always applies, even if MarginBeforeExpiry or PermanentWithoutExpiry is effective,
+	// as a safety net against clock skew or wrong Expiry.
+	MaxRefreshInterval time.Duration
+
+	// MinRefreshWait is the minimum wait before the next background refresh scheduled by MarginBeforeExpiry or CombineIntervalAndExpiry.
+	// It prevents busy refreshing when the token is shorter-lived than MarginBeforeExpiry.
+	// If not set, DefaultMinRefreshWait is used.
+	MinRefreshWait time.Duration
+
+	// MinForceRefreshInterval is the minimum interval between forced refreshes by ForceRefresh.
+	// If not set, DefaultMinForceRefreshInterval is used. Negative value disables the limit.
+	MinForceRefreshInterval time.Duration
+
+	// CircuitBreakerThreshold makes Token() fail fast after this number of consecutive failures of token fetching
+	// instead of refreshing synchronously on every call. Zero disables the circuit breaker.
+	// While the circuit is open, Token() returns the last token if it is not expired yet, otherwise *CircuitOpenError.
+	// The background refresh and ForceRefresh are not affected, and a success closes the circuit.
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long the circuit stays open. After that, the next Token() call tries to refresh again.
+	// If not set, DefaultCircuitBreakerCooldown is used.
+	CircuitBreakerCooldown time.Duration
+
+	// RandFloat64 is the source of the jitter of refresh timing, which returns a pseudo-random number in [0.0, 1.0).
+	// Set a seeded source (e.g. rand.New(rand.NewSource(1)).Float64) with Clock for deterministic tests.
+	// Calls are serialized, so *rand.Rand can be used though it is not safe for concurrent use. If not set, math/rand.Float64 is used.
+	// It is not applied to the randomization of the backoff (e.g. backoff.ExponentialBackOff.RandomizationFactor).
+	RandFloat64 func() float64
+
+	// Clock is the source of time for refresh timing.
+	// If not set, the real time is used.
+	Clock Clock
+
+	// Logger is the logger for refresh lifecycle events.
+	// If not set, logs are discarded.
+	Logger Logger
+
+	// Debug enables logging of HTTP requests and responses of token refreshing with secrets redacted to Logger.Debugf.
+	// It is only effective for the token sources which respect oauth2.HTTPClient context value (e.g. google.DefaultTokenSource).
+	Debug bool
 }
 
-// AsyncRefreshingTokenSource create TokenSource with the refresh config conf and the TokenSource generator function genFunc.
-// genFunc will be called to generate the one-time TokenSource instance every time to refresh.
-// Note: AsyncRefreshingTokenSource fetches the first token synchronously.
+// Validate returns an error if conf is impossible configuration.
+func (conf AsyncRefreshingConfig) Validate() error {
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"MarginBeforeExpiry", conf.MarginBeforeExpiry},
+		{"RefreshInterval", conf.RefreshInterval},
+		{"WarmUpPeriod", conf.WarmUpPeriod},
+		{"MinRefreshWait", conf.MinRefreshWait},
+		{"MaxRefreshInterval", conf.MaxRefreshInterval},
+		{"CircuitBreakerCooldown", conf.CircuitBreakerCooldown},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("invalid AsyncRefreshingConfig: %s must not be negative, but got %v", d.name, d.value)
+		}
+	}
+	if conf.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("invalid AsyncRefreshingConfig: CircuitBreakerThreshold must not be negative, but got %v", conf.CircuitBreakerThreshold)
+	}
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{
+		{"RandomizationFactorForMarginBeforeExpiry", conf.RandomizationFactorForMarginBeforeExpiry},
+		{"RandomizationFactorForRefreshInterval", conf.RandomizationFactorForRefreshInterval},
+		{"InitialJitterFactor", conf.InitialJitterFactor},
+		{"SyncRetryJitterFactor", conf.SyncRetryJitterFactor},
+	} {
+		// backoff package requires [0, 1).
+		if f.value < 0 || f.value >= 1 {
+			return fmt.Errorf("invalid AsyncRefreshingConfig: %s must be in [0, 1), but got %v", f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// AsyncRefreshingTokenSource generate oauth2.TokenSource which refreshes the token asynchronously.
+//
+// Deprecated: Use NewAsyncRefreshingTokenSource, which returns *AsyncTokenSource to reach methods like Close and ForceRefresh.
 func AsyncRefreshingTokenSource(ctx context.Context, conf AsyncRefreshingConfig, genFunc func(ctx context.Context) (oauth2.TokenSource, error)) (oauth2.TokenSource, error) {
+	ts, err := NewAsyncRefreshingTokenSource(ctx, conf, genFunc)
+	if err != nil {
+		// Don't return the typed nil pointer as non-nil oauth2.TokenSource.
+		return nil, err
+	}
+	return ts, nil
+}
+
+// NewAsyncRefreshingTokenSource create AsyncTokenSource with the refresh config conf and the TokenSource generator function genFunc.
+// genFunc will be called to generate the one-time TokenSource instance every time to refresh.
+// Note: NewAsyncRefreshingTokenSource fetches the first token synchronously unless conf.LazyInit is set.
+// ctx bounds the lifetime of the background refresh, so it should live as long as the token source (not a request context).
+// Token() uses only the values of ctx; use TokenContext to refresh with a per-call context.
+func NewAsyncRefreshingTokenSource(ctx context.Context, conf AsyncRefreshingConfig, genFunc func(ctx context.Context) (oauth2.TokenSource, error)) (*AsyncTokenSource, error) {
+	return NewAsyncRefreshingTokenSourceWithOptions(ctx, genFunc, WithConfig(conf))
+}
+
+// NewAsyncRefreshingTokenSourceWithOptions create AsyncTokenSource with the TokenSource generator function genFunc configured by opts.
+// Unspecified options fall back to the same defaults as AsyncRefreshingConfig.
+func NewAsyncRefreshingTokenSourceWithOptions(ctx context.Context, genFunc func(ctx context.Context) (oauth2.TokenSource, error), opts ...Option) (*AsyncTokenSource, error) {
+	var conf AsyncRefreshingConfig
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 	if conf.RefreshInterval == 0 {
-		conf.RefreshInterval = defaultInterval
+		conf.RefreshInterval = DefaultRefreshInterval
+	}
+	if conf.MinRefreshWait == 0 {
+		conf.MinRefreshWait = DefaultMinRefreshWait
+	}
+	if conf.MinForceRefreshInterval == 0 {
+		conf.MinForceRefreshInterval = DefaultMinForceRefreshInterval
+	}
+	if conf.CircuitBreakerThreshold > 0 && conf.CircuitBreakerCooldown == 0 {
+		conf.CircuitBreakerCooldown = DefaultCircuitBreakerCooldown
+	}
+	if conf.Clock == nil {
+		conf.Clock = realClock{}
+	}
+	if conf.Logger == nil {
+		conf.Logger = nopLogger{}
+	}
+	if conf.IsRetryable == nil && conf.retriesConfigured() {
+		conf.Logger.Warnf("AsyncRefreshingTokenSource: Backoff is set but IsRetryable is not, so refreshes are never retried")
+	}
+	valueCtx := valueOnlyContext{parent: ctx}
+	sharedCtx, cancelShared := context.WithCancel(valueCtx)
+	ctx, cancelLoop := context.WithCancel(ctx)
+	cancel := func() {
+		cancelLoop()
+		cancelShared()
 	}
-	if conf.Backoff == nil {
-		conf.Backoff = backoff.NewExponentialBackOff()
+	b := &AsyncTokenSource{genFunc: genFunc, conf: conf, createdAt: conf.Clock.Now(), ctx: ctx, valueCtx: valueCtx, sharedCtx: sharedCtx, cancel: cancel, resetC: make(chan struct{}, 1), readyC: make(chan struct{}), stopC: make(chan struct{}), loopDone: make(chan struct{})}
+	if conf.LazyInit {
+		return b, nil
 	}
-	b := &asyncRefreshingTokenSource{genFunc: genFunc, conf: conf}
-	expiry, err := b.flip(ctx)
+	begin := conf.Clock.Now()
+	expiry, err := b.flip(ctx, TriggerInitial)
+	b.mu.Lock()
+	b.recordFetchLocked(TriggerInitial, conf.Clock.Now().Sub(begin))
+	b.mu.Unlock()
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	go b.run(ctx, expiry)
+	b.startLoop(expiry)
 	return b, nil
 }
 
-func (ts *asyncRefreshingTokenSource) flip(ctx context.Context) (time.Time, error) {
-	var token *oauth2.Token
-	err := backoff.Retry(func() error {
-		tokenSource, err := ts.genFunc(ctx)
-		if err != nil {
-			return err
-		}
+// startLoop starts the background refresh loop if it is not started yet.
+func (ts *AsyncTokenSource) startLoop(expiry time.Time) {
+	ts.startOnce.Do(func() {
+		ts.checkRefreshInterval(expiry)
+		go ts.run(ts.ctx, expiry)
+	})
+}
+
+// checkRefreshInterval detects RefreshInterval much shorter than the token lifetime, which wastes IAM quota.
+// It must be called before run.
+func (ts *AsyncTokenSource) checkRefreshInterval(expiry time.Time) {
+	if ts.conf.MarginBeforeExpiry != 0 || expiry.IsZero() {
+		return
+	}
+	lifetime := expiry.Sub(ts.conf.Clock.Now())
+	if lifetime < shortIntervalRatio*ts.conf.RefreshInterval {
+		return
+	}
+	if ts.conf.AutoExtendRefreshInterval {
+		ts.conf.Logger.Warnf("AsyncRefreshingTokenSource: RefreshInterval %v is extended to %v because the token lifetime is %v", ts.conf.RefreshInterval, lifetime/2, lifetime)
+		ts.mu.Lock()
+		ts.conf.RefreshInterval = lifetime / 2
+		ts.mu.Unlock()
+		return
+	}
+	ts.conf.Logger.Warnf("AsyncRefreshingTokenSource: RefreshInterval %v is much shorter than the token lifetime %v, consider MarginBeforeExpiry", ts.conf.RefreshInterval, lifetime)
+}
+
+func (ts *AsyncTokenSource) flip(ctx context.Context, trigger RefreshTrigger) (time.Time, error) {
+	begin := ts.conf.Clock.Now()
+	token, err := ts.retrieve(ctx, trigger)
+
+	ts.mu.Lock()
+	// Keep the last good token on failure, even if it is expired.
+	if err == nil {
+		ts.setTokenLocked(token)
+	}
+	ts.recordResultLocked(err)
+	ts.mu.Unlock()
+	ts.onRefresh(token, err, ts.conf.Clock.Now().Sub(begin))
+
+	if err != nil {
+		return time.Time{}, err
+	}
+	return token.Expiry, nil
+}
 
-		t, err := tokenSource.Token()
+// onRefresh calls OnRefresh if it is set. It must be called without holding ts.mu.
+func (ts *AsyncTokenSource) onRefresh(token *oauth2.Token, err error, elapsed time.Duration) {
+	if ts.conf.OnRefresh != nil {
+		ts.conf.OnRefresh(cloneToken(token), err, elapsed)
+	}
+}
+
+// NoBackoff is the value of AsyncRefreshingConfig.NewBackoff to disable retries regardless of IsRetryable.
+func NoBackoff() backoff.BackOff {
+	return &backoff.StopBackOff{}
+}
+
+// retriesConfigured reports whether NewBackoff or Backoff is set to retry, i.e. not to *backoff.StopBackOff like NoBackoff.
+// It calls NewBackoff once.
+func (conf AsyncRefreshingConfig) retriesConfigured() bool {
+	var b backoff.BackOff
+	switch {
+	case conf.NewBackoff != nil:
+		b = conf.NewBackoff()
+	case conf.Backoff != nil:
+		b = conf.Backoff
+	default:
+		return false
+	}
+	_, stop := b.(*backoff.StopBackOff)
+	return !stop
+}
+
+// rnd returns RandFloat64 serialized by randMu, or math/rand.Float64 as the default.
+func (ts *AsyncTokenSource) rnd() func() float64 {
+	if ts.conf.RandFloat64 == nil {
+		return rand.Float64
+	}
+	return func() float64 {
+		ts.randMu.Lock()
+		defer ts.randMu.Unlock()
+		return ts.conf.RandFloat64()
+	}
+}
+
+// newBackoff returns the backoff for a refresh from NewBackoff, Backoff or the default.
+// The defaults are not stored in conf, so String() of conf can tell whether they are customized.
+func (ts *AsyncTokenSource) newBackoff() backoff.BackOff {
+	switch {
+	case ts.conf.NewBackoff != nil:
+		return ts.conf.NewBackoff()
+	case ts.conf.Backoff != nil:
+		return ts.conf.Backoff
+	default:
+		return backoff.NewExponentialBackOff()
+	}
+}
+
+// retryBackoff returns the backoff for a refresh by trigger, with SyncRetryJitterFactor applied to the synchronous refresh.
+func (ts *AsyncTokenSource) retryBackoff(trigger RefreshTrigger) backoff.BackOff {
+	b := ts.newBackoff()
+	if trigger == TriggerOnDemand && ts.conf.SyncRetryJitterFactor > 0 {
+		return &jitteredBackOff{BackOff: b, randomizationFactor: ts.conf.SyncRetryJitterFactor, rnd: ts.rnd()}
+	}
+	return b
+}
+
+// jitteredBackOff randomizes the waits of BackOff.
+type jitteredBackOff struct {
+	backoff.BackOff
+	randomizationFactor float64
+	rnd                 func() float64
+}
+
+func (b *jitteredBackOff) NextBackOff() time.Duration {
+	d := b.BackOff.NextBackOff()
+	if d == backoff.Stop {
+		return d
+	}
+	return withJitter(b.rnd, d, b.randomizationFactor)
+}
+
+// retrieve fetches a new token with the configured NewBackoff and IsRetryable. It returns *RefreshError on failure.
+func (ts *AsyncTokenSource) retrieve(ctx context.Context, trigger RefreshTrigger) (token *oauth2.Token, err error) {
+	if ts.conf.RefreshContext != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = ts.conf.RefreshContext(ctx)
+		defer cancel()
+	}
+	if ts.conf.Tracer != nil {
+		var end func(err error)
+		ctx, end = ts.conf.Tracer.StartRefresh(ctx, trigger)
+		defer func() { end(err) }()
+	}
+
+	var attempt int
+	var retrying bool
+	begin := ts.conf.Clock.Now()
+	ts.logEvent(RefreshEvent{Message: EventRefreshStarted})
+	err = backoff.RetryNotifyWithTimer(func() error {
+		attempt++
+		t, err := ts.fetch(ctx, trigger)
 		if err != nil {
-			if os.Getenv("DEBUG") != "" {
-				log.Printf("asyncRefreshingTokenSource.flip() error: %v", err)
-			}
-			if ts.conf.IsRetryable == nil || !ts.conf.IsRetryable(err) {
+			retrying = !errors.Is(err, ErrPanicked) && ts.conf.IsRetryable != nil && ts.conf.IsRetryable(err)
+			if !retrying {
 				return backoff.Permanent(err)
 			}
+			ts.logEvent(RefreshEvent{Message: EventRefreshRetrying, Attempt: attempt, Elapsed: ts.conf.Clock.Now().Sub(begin), Err: err})
 			return err
 		}
 		token = t
 		return nil
-	}, ts.conf.Backoff)
-
-	ts.mu.Lock()
-	ts.token = token
-	ts.mu.Unlock()
+	}, backoff.WithContext(ts.retryBackoff(trigger), ctx), nil, &backoffTimer{clock: ts.conf.Clock})
 
+	switch {
+	case err == nil:
+		ts.logEvent(RefreshEvent{Message: EventRefreshSucceeded, Attempt: attempt, Elapsed: ts.conf.Clock.Now().Sub(begin), Expiry: token.Expiry})
+	case retrying:
+		ts.logEvent(RefreshEvent{Message: EventRefreshGaveUp, Attempt: attempt, Elapsed: ts.conf.Clock.Now().Sub(begin), Err: err})
+	default:
+		ts.logEvent(RefreshEvent{Message: EventRefreshFailed, Attempt: attempt, Elapsed: ts.conf.Clock.Now().Sub(begin), Err: err})
+	}
 	if err != nil {
-		return time.Time{}, err
+		ts.mu.Lock()
+		hasToken := ts.token != nil
+		ts.mu.Unlock()
+		return nil, &RefreshError{Err: err, Attempts: attempt, Elapsed: ts.conf.Clock.Now().Sub(begin), HasToken: hasToken}
 	}
-	return token.Expiry, nil
+	return token, nil
 }
 
-func (ts *asyncRefreshingTokenSource) run(ctx context.Context, initialExpiry time.Time) {
-	ticker := tickerWithJitter(ts.conf.RefreshInterval, ts.conf.RandomizationFactorForRefreshInterval)
-	defer ticker.Stop()
+func (ts *AsyncTokenSource) run(ctx context.Context, initialExpiry time.Time) {
+	defer close(ts.loopDone)
+	// The ticker runs only while the next refresh is not scheduled by handleExpiry.
+	var ticker *backoff.Ticker
+	var tickerC <-chan time.Time
+	stopTicker := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tickerC = nil, nil
+		}
+	}
+	defer stopTicker()
+	startTicker := func() {
+		stopTicker()
+		interval := ts.conf.RefreshInterval
+		if ts.conf.MaxRefreshInterval > 0 && interval > ts.conf.MaxRefreshInterval {
+			interval = ts.conf.MaxRefreshInterval
+		}
+		ticker = tickerWithJitter(ts.conf.Clock, ts.rnd(), interval, ts.conf.RandomizationFactorForRefreshInterval)
+		tickerC = ticker.C
+	}
 
-	handleExpiry := func(expiry time.Time) <-chan time.Time {
-		if ts.conf.MarginBeforeExpiry != 0 && !expiry.IsZero() {
-			delta := time.Duration(ts.conf.RandomizationFactorForMarginBeforeExpiry * float64(ts.conf.MarginBeforeExpiry))
-			// [-1.0,1.0)
-			plusMinus1 := 2 * (rand.Float64() - 0.5)
-			jitter := time.Duration(plusMinus1 * float64(delta))
-			targetTime := expiry.Add(-ts.conf.MarginBeforeExpiry + jitter)
-			return time.After(time.Until(targetTime))
-		} else {
-			return nil
+	// handleExpiry returns the timer channel of the next refresh, or nil if the ticker drives it.
+	// If initial is true, InitialJitterFactor is applied and the first interval based refresh is also scheduled by the timer.
+	handleExpiry := func(expiry time.Time, initial bool) <-chan time.Time {
+		var wait time.Duration
+		hasTarget := ts.conf.MarginBeforeExpiry != 0 && !expiry.IsZero()
+		if hasTarget {
+			jitter := withJitter
+			if ts.conf.MarginJitterOneSided {
+				jitter = withPositiveJitter
+			}
+			margin := jitter(ts.rnd(), ts.conf.MarginBeforeExpiry, ts.conf.RandomizationFactorForMarginBeforeExpiry)
+			targetTime := expiry.Add(-margin)
+			wait = targetTime.Sub(ts.conf.Clock.Now())
 		}
+		if ts.conf.CombineIntervalAndExpiry {
+			// The ticker is not used in this mode, so the interval is measured from the last refresh.
+			if interval := withJitter(ts.rnd(), ts.conf.RefreshInterval, ts.conf.RandomizationFactorForRefreshInterval); !hasTarget || interval < wait {
+				wait = interval
+			}
+		} else if !hasTarget {
+			if !initial {
+				// The ticker drives the next refresh.
+				ts.setNextRefresh(time.Time{})
+				return nil
+			}
+			// The ticker starts after the first refresh.
+			wait = ts.conf.RefreshInterval
+			// The initial token can be a cached one near Expiry (e.g. NewFileCachedTokenSource), so refresh it before it expires.
+			if remaining := expiry.Sub(ts.conf.Clock.Now()); !expiry.IsZero() && remaining < wait {
+				wait = remaining / 2
+			}
+		}
+		if initial {
+			wait = withNegativeJitter(ts.rnd(), wait, ts.conf.InitialJitterFactor)
+		}
+		// The target can be in the past if the token is shorter-lived than the margin.
+		// Refreshing immediately would spin until a longer-lived token is fetched.
+		if wait < ts.conf.MinRefreshWait {
+			wait = ts.conf.MinRefreshWait
+		}
+		if ts.conf.MaxRefreshInterval > 0 && wait > ts.conf.MaxRefreshInterval {
+			wait = ts.conf.MaxRefreshInterval
+		}
+		ts.setNextRefresh(ts.conf.Clock.Now().Add(wait))
+		return ts.conf.Clock.NewTimer(wait).C()
+	}
+
+	// retryAfterSkip returns the timer channel of the next attempt after BeforeRefresh skipped the refresh.
+	// It is not later than RefreshInterval nor the target time of MarginBeforeExpiry, so the skip doesn't let the token expire.
+	retryAfterSkip := func() <-chan time.Time {
+		now := ts.conf.Clock.Now()
+		wait := ts.conf.RefreshInterval
+		if expiry := ts.Expiry(); !expiry.IsZero() {
+			if untilTarget := expiry.Add(-ts.conf.MarginBeforeExpiry).Sub(now); untilTarget < wait {
+				wait = untilTarget
+			}
+		}
+		if wait < ts.conf.MinRefreshWait {
+			wait = ts.conf.MinRefreshWait
+		}
+		if ts.conf.MaxRefreshInterval > 0 && wait > ts.conf.MaxRefreshInterval {
+			wait = ts.conf.MaxRefreshInterval
+		}
+		timer := ts.conf.Clock.NewTimer(wait)
+		ts.setNextRefresh(now.Add(wait))
+		return timer.C()
 	}
 
-	waitUntilExpiryC := handleExpiry(initialExpiry)
+	var waitUntilExpiryC <-chan time.Time
+	// schedule arranges the next refresh. An already running ticker is kept unless restart is true.
+	schedule := func(expiry time.Time, restart bool) {
+		if ts.conf.PermanentWithoutExpiry && expiry.IsZero() {
+			stopTicker()
+			if ts.conf.MaxRefreshInterval > 0 {
+				ts.setNextRefresh(ts.conf.Clock.Now().Add(ts.conf.MaxRefreshInterval))
+				waitUntilExpiryC = ts.conf.Clock.NewTimer(ts.conf.MaxRefreshInterval).C()
+			} else {
+				ts.setNextRefresh(time.Time{})
+				waitUntilExpiryC = nil
+			}
+			return
+		}
+		waitUntilExpiryC = handleExpiry(expiry, false)
+		switch {
+		case waitUntilExpiryC != nil:
+			stopTicker()
+		case ticker == nil || restart:
+			startTicker()
+		}
+	}
+	// In the interval based refreshing, the initial token expiring before the first tick is also scheduled by handleExpiry.
+	expiresBeforeTick := ts.conf.MarginBeforeExpiry == 0 && !ts.conf.CombineIntervalAndExpiry &&
+		!initialExpiry.IsZero() && initialExpiry.Sub(ts.conf.Clock.Now()) < ts.conf.RefreshInterval
+	if (ts.conf.InitialJitterFactor > 0 || expiresBeforeTick) && !(ts.conf.PermanentWithoutExpiry && initialExpiry.IsZero()) {
+		waitUntilExpiryC = handleExpiry(initialExpiry, true)
+	} else {
+		schedule(initialExpiry, false)
+	}
 
 loop:
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			// ignore ticker during waiting until expiry
-			if waitUntilExpiryC != nil {
+		case <-ts.stopC:
+			return
+		case <-tickerC:
+		case <-waitUntilExpiryC:
+		case <-ts.resetC:
+			// ForceRefresh has refreshed the token, so the next refresh is measured from now.
+			schedule(ts.Expiry(), true)
+			continue loop
+		}
+
+		// Don't start a new refresh once Shutdown is called, even if the timer fired at the same time.
+		select {
+		case <-ts.stopC:
+			return
+		default:
+		}
+
+		if ts.conf.BeforeRefresh != nil {
+			if err := ts.conf.BeforeRefresh(ctx); err != nil {
+				ts.conf.Logger.Debugf("AsyncRefreshingTokenSource skipped refresh: %v", err)
+				stopTicker()
+				waitUntilExpiryC = retryAfterSkip()
 				continue loop
 			}
-		case <-waitUntilExpiryC:
 		}
 
-		expiry, err := ts.flip(ctx)
+		begin := ts.conf.Clock.Now()
+		expiry, err := ts.flip(ctx, TriggerBackground)
+		ts.mu.Lock()
+		ts.recordRefreshLocked(ts.conf.Clock.Now().Sub(begin))
+		ts.mu.Unlock()
 		if err != nil {
-			log.Println("asyncRefreshingTokenSource encounter unresolved error:", err)
+			ts.conf.Logger.Errorf("AsyncRefreshingTokenSource encounter unresolved error: %v", err)
 		}
-		waitUntilExpiryC = handleExpiry(expiry)
+		schedule(expiry, false)
 	}
 }
 
-func tickerWithJitter(d time.Duration, randomizationFactor float64) *backoff.Ticker {
+// jitterIn randomizes d in [d*(1+lower*randomizationFactor), d*(1+upper*randomizationFactor)) uniformly.
+// All jitters of refresh timing, including the ticker and the synchronous retry, are applied by it to share the same distribution.
+func jitterIn(rnd func() float64, d time.Duration, randomizationFactor, lower, upper float64) time.Duration {
+	return d + time.Duration((lower+(upper-lower)*rnd())*randomizationFactor*float64(d))
+}
+
+// withJitter randomizes d in [d*(1-randomizationFactor), d*(1+randomizationFactor)).
+func withJitter(rnd func() float64, d time.Duration, randomizationFactor float64) time.Duration {
+	return jitterIn(rnd, d, randomizationFactor, -1, 1)
+}
+
+// withPositiveJitter randomizes d in [d, d*(1+randomizationFactor)).
+func withPositiveJitter(rnd func() float64, d time.Duration, randomizationFactor float64) time.Duration {
+	return jitterIn(rnd, d, randomizationFactor, 0, 1)
+}
+
+// withNegativeJitter randomizes d in [d*(1-randomizationFactor), d).
+func withNegativeJitter(rnd func() float64, d time.Duration, randomizationFactor float64) time.Duration {
+	return jitterIn(rnd, d, randomizationFactor, -1, 0)
+}
+
+// setNextRefresh records the scheduled time of the next refresh.
+// Zero time means it is driven by the ticker or no refresh is scheduled.
+func (ts *AsyncTokenSource) setNextRefresh(t time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.nextRefresh = t
+}
+
+func tickerWithJitter(clock Clock, rnd func() float64, d time.Duration, randomizationFactor float64) *backoff.Ticker {
 	// (Implementation detail) It use backoff package to reduce dependency.
-	backoffForJitteredTicker := &backoff.ExponentialBackOff{
-		InitialInterval:     d,
-		RandomizationFactor: randomizationFactor,
-		Multiplier:          1.0,
-		MaxInterval:         d,
-		MaxElapsedTime:      0,
-		Clock:               backoff.SystemClock,
+	// The jitter is applied by jitteredBackOff instead of ExponentialBackOff to use rnd.
+	backoffForJitteredTicker := &jitteredBackOff{
+		BackOff:             &backoff.ConstantBackOff{Interval: d},
+		randomizationFactor: randomizationFactor,
+		rnd:                 rnd,
 	}
-	backoffForJitteredTicker.Reset()
 
-	return backoff.NewTicker(backoffForJitteredTicker)
+	ticker := backoff.NewTickerWithTimer(backoffForJitteredTicker, &backoffTimer{clock: clock})
+	// backoff.Ticker ticks immediately, but the first tick should be after d because the token has just been fetched.
+	<-ticker.C
+	return ticker
 }
@@ -0,0 +1,1126 @@
+package tokensource_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"golang.org/x/oauth2"
+
+	"github.com/apstndb/tokensource"
+	"github.com/apstndb/tokensource/tokensourcetest"
+)
+
+// slowTokenSource returns the token of FakeTokenSource after delay.
+type slowTokenSource struct {
+	*tokensourcetest.FakeTokenSource
+	delay time.Duration
+}
+
+func (s slowTokenSource) Token() (*oauth2.Token, error) {
+	time.Sleep(s.delay)
+	return s.FakeTokenSource.Token()
+}
+
+func TestTokenContext_CancelledCallerDoesNotFailOthers(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return slowTokenSource{FakeTokenSource: fake, delay: 200 * time.Millisecond}, nil
+	}, func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	var shortErr, plainErr error
+	var plainToken *oauth2.Token
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, shortErr = ts.TokenContext(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		// Let TokenContext start the shared refresh.
+		time.Sleep(10 * time.Millisecond)
+		plainToken, plainErr = ts.Token()
+	}()
+	wg.Wait()
+
+	if !errors.Is(shortErr, context.DeadlineExceeded) {
+		t.Errorf("TokenContext with deadline: want context.DeadlineExceeded, got %v", shortErr)
+	}
+	if plainErr != nil {
+		t.Fatalf("Token() must not fail by the cancelled caller: %v", plainErr)
+	}
+	if plainToken.AccessToken != "token" {
+		t.Errorf("want token, got %q", plainToken.AccessToken)
+	}
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("concurrent callers must share one refresh, but Token() of the source is called %d times", calls)
+	}
+}
+
+func TestWaitReady_LazyInitFetches(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ts.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady with LazyInit must fetch the first token: %v", err)
+	}
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("want 1 fetch, got %d", calls)
+	}
+}
+
+func TestToken_CountsExpiredServed(t *testing.T) {
+	// oauth2.Token.Valid rejects the token within 10 seconds of Expiry.
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("stale", time.Now().Add(5*time.Second)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) {
+		c.Clock = tokensourcetest.NewFakeClock(time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "stale" {
+		t.Errorf("want stale, got %q", token.AccessToken)
+	}
+	if got := ts.Stats().ExpiredServed; got != 1 {
+		t.Errorf("ExpiredServed: want 1, got %d", got)
+	}
+}
+
+// triggerRecorder is tokensource.RefreshTracer which records the triggers.
+type triggerRecorder struct {
+	mu       sync.Mutex
+	triggers []tokensource.RefreshTrigger
+}
+
+func (r *triggerRecorder) StartRefresh(ctx context.Context, trigger tokensource.RefreshTrigger) (context.Context, func(err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.triggers = append(r.triggers, trigger)
+	return ctx, func(err error) {}
+}
+
+func (r *triggerRecorder) Triggers() []tokensource.RefreshTrigger {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]tokensource.RefreshTrigger(nil), r.triggers...)
+}
+
+func TestToken_LazyInitRecordsInitialFetch(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	tracer := &triggerRecorder{}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) {
+		c.LazyInit = true
+		c.Tracer = tracer
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tracer.Triggers(); len(got) != 1 || got[0] != tokensource.TriggerInitial {
+		t.Errorf("triggers: want [%v], got %v", tokensource.TriggerInitial, got)
+	}
+	if got := ts.Stats().Refreshes; got != 0 {
+		t.Errorf("the first fetch must not be counted as a refresh, but Refreshes is %d", got)
+	}
+}
+
+func TestNewAsyncRefreshingTokenSource_WarnsBackoffWithoutIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		newBackoff func() backoff.BackOff
+		wantWarn   bool
+	}{
+		{"default", nil, false},
+		{"NoBackoff", tokensource.NoBackoff, false},
+		{"StopBackOff", func() backoff.BackOff { return &backoff.StopBackOff{} }, false},
+		{"exponential", func() backoff.BackOff { return backoff.NewExponentialBackOff() }, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+			logger := &recordingLogger{}
+			ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), tokensource.WithLogger(logger), func(c *tokensource.AsyncRefreshingConfig) {
+				c.NewBackoff = tt.newBackoff
+				c.LazyInit = true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ts.Close()
+			if got := logger.count("WARN") > 0; got != tt.wantWarn {
+				t.Errorf("warning: want %v, got %v: %s", tt.wantWarn, got, logger)
+			}
+		})
+	}
+}
+
+// waitForCalls waits until Token() of fake is called n times by the background refresh.
+func waitForCalls(t *testing.T, fake *tokensourcetest.FakeTokenSource, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Calls() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d calls of Token(), got %d", n, fake.Calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// nextRefresh returns the scheduled time of the next refresh from DebugState.
+func nextRefresh(t *testing.T, ts *tokensource.AsyncTokenSource) time.Time {
+	t.Helper()
+	b, err := ts.DebugState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state struct {
+		NextRefresh time.Time `json:"next_refresh"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state.NextRefresh
+}
+
+// waitForNextRefresh waits until the next refresh is scheduled at want.
+func waitForNextRefresh(t *testing.T, ts *tokensource.AsyncTokenSource, want time.Time) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for got := nextRefresh(t, ts); !got.Equal(want); got = nextRefresh(t, ts) {
+		if time.Now().After(deadline) {
+			t.Fatalf("next refresh: want %v, got %v", want, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRun_MarginBeforeExpiryOverridesRefreshInterval(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithRefreshInterval(time.Minute), tokensource.WithMarginBeforeExpiry(10*time.Minute),
+		func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	if got, want := nextRefresh(t, ts), now.Add(50*time.Minute); !got.Equal(want) {
+		t.Errorf("next refresh: want %v, got %v", want, got)
+	}
+	// Only the timer of MarginBeforeExpiry is running, not the ticker of RefreshInterval.
+	if got := clock.PendingTimers(); got != 1 {
+		t.Errorf("want 1 pending timer, got %d", got)
+	}
+	clock.Advance(49 * time.Minute)
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("RefreshInterval must not refresh while MarginBeforeExpiry is effective, but Token() is called %d times", calls)
+	}
+	clock.Advance(time.Minute)
+	waitForCalls(t, fake, 2)
+}
+
+func TestRun_CombineIntervalAndExpiry(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithRefreshInterval(5*time.Minute), tokensource.WithMarginBeforeExpiry(10*time.Minute),
+		func(c *tokensource.AsyncRefreshingConfig) {
+			c.Clock = clock
+			c.CombineIntervalAndExpiry = true
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// The interval fires even though the token is long-lived.
+	for i := 1; i <= 2; i++ {
+		clock.WaitForTimers(1)
+		if got, want := nextRefresh(t, ts), clock.Now().Add(5*time.Minute); !got.Equal(want) {
+			t.Errorf("next refresh: want %v, got %v", want, got)
+		}
+		clock.Advance(5 * time.Minute)
+		waitForCalls(t, fake, i+1)
+	}
+}
+
+func TestRun_ShortLivedTokenDoesNotSpin(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	// The token expires before Expiry - MarginBeforeExpiry, so the target time is in the past.
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(5*time.Minute)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithMarginBeforeExpiry(10*time.Minute),
+		func(c *tokensource.AsyncRefreshingConfig) {
+			c.Clock = clock
+			c.MinRefreshWait = time.Minute
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	if got, want := nextRefresh(t, ts), now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("next refresh must be clamped to MinRefreshWait: want %v, got %v", want, got)
+	}
+	clock.Advance(time.Minute)
+	waitForCalls(t, fake, 2)
+	// The next refresh is scheduled after MinRefreshWait again instead of refreshing immediately.
+	clock.WaitForTimers(1)
+	if calls := fake.Calls(); calls != 2 {
+		t.Errorf("want 2 calls of Token(), got %d", calls)
+	}
+	if got, want := nextRefresh(t, ts), clock.Now().Add(time.Minute); !got.Equal(want) {
+		t.Errorf("next refresh: want %v, got %v", want, got)
+	}
+}
+
+func TestRun_InitialTokenExpiringBeforeFirstTick(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	// e.g. a cached token with 5 minutes left.
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("cached", now.Add(5*time.Minute)),
+		tokensourcetest.TokenResponse("fresh", now.Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithRefreshInterval(30*time.Minute),
+		func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	if got, want := nextRefresh(t, ts), now.Add(150*time.Second); !got.Equal(want) {
+		t.Errorf("next refresh: want %v, got %v", want, got)
+	}
+	clock.Advance(150 * time.Second)
+	waitForCalls(t, fake, 2)
+}
+
+func TestRun_BeforeRefreshSkipsOneCycle(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	errFrozen := errors.New("freeze window")
+	var mu sync.Mutex
+	var hookCalls int
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithRefreshInterval(time.Minute),
+		func(c *tokensource.AsyncRefreshingConfig) {
+			c.Clock = clock
+			c.BeforeRefresh = func(ctx context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				hookCalls++
+				if hookCalls == 1 {
+					return errFrozen
+				}
+				return nil
+			}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	clock.Advance(time.Minute)
+	// The next attempt is scheduled after RefreshInterval.
+	waitForNextRefresh(t, ts, now.Add(2*time.Minute))
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("the refresh must be skipped while BeforeRefresh returns an error, but Token() is called %d times", calls)
+	}
+	if err := ts.LastError(); err != nil {
+		t.Errorf("the skipped refresh must not be a failure, but LastError is %v", err)
+	}
+	clock.Advance(time.Minute)
+	waitForCalls(t, fake, 2)
+	mu.Lock()
+	defer mu.Unlock()
+	if hookCalls != 2 {
+		t.Errorf("want 2 calls of BeforeRefresh, got %d", hookCalls)
+	}
+}
+
+func TestToken_ReturnsCopy(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.AccessToken = ""
+	token.Expiry = time.Time{}
+
+	token, err = ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token" || token.Expiry.IsZero() {
+		t.Errorf("the cached token must not be mutated by the caller, got %+v", token)
+	}
+}
+
+func BenchmarkToken(b *testing.B) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ts.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ts.Token(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkToken_Parallel(b *testing.B) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ts.Close()
+
+	for _, parallelism := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("goroutines_per_cpu=%d", parallelism), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetParallelism(parallelism)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := ts.Token(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// advancingTokenSource advances clock by the next of delays on each Token() call to simulate slow fetches.
+type advancingTokenSource struct {
+	*tokensourcetest.FakeTokenSource
+	clock  *tokensourcetest.FakeClock
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (s *advancingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	if len(s.delays) > 0 {
+		s.clock.Advance(s.delays[0])
+		s.delays = s.delays[1:]
+	}
+	s.mu.Unlock()
+	return s.FakeTokenSource.Token()
+}
+
+func TestStats_InitialFetchAndRefreshes(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	source := &advancingTokenSource{FakeTokenSource: fake, clock: clock, delays: []time.Duration{2 * time.Second, 3 * time.Second}}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return source, nil
+	}, tokensource.WithMarginBeforeExpiry(10*time.Minute), func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	stats := ts.Stats()
+	if stats.InitialFetchDuration != 2*time.Second || stats.Refreshes != 0 {
+		t.Errorf("after the initial fetch: want InitialFetchDuration 2s and no refresh, got %+v", stats)
+	}
+
+	clock.WaitForTimers(1)
+	clock.Advance(time.Hour)
+	waitForCalls(t, fake, 2)
+	// Stats are recorded after the refresh, before the next one is scheduled.
+	clock.WaitForTimers(1)
+	stats = ts.Stats()
+	if stats.InitialFetchDuration != 2*time.Second {
+		t.Errorf("InitialFetchDuration must be recorded once: want 2s, got %v", stats.InitialFetchDuration)
+	}
+	if stats.Refreshes != 1 || stats.LastRefreshDuration != 3*time.Second {
+		t.Errorf("after the background refresh: want 1 refresh of 3s, got %+v", stats)
+	}
+	if stats.Successes != 2 {
+		t.Errorf("Successes: want 2, got %d", stats.Successes)
+	}
+}
+
+func TestToken_ValidatesDuringWarmUp(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	var mu sync.Mutex
+	var validated int
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) {
+		c.Clock = clock
+		c.WarmUpPeriod = time.Minute
+		c.ValidateToken = func(ctx context.Context, token *oauth2.Token) error {
+			mu.Lock()
+			defer mu.Unlock()
+			validated++
+			return nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if validated != 1 {
+		t.Errorf("ValidateToken must be called only during WarmUpPeriod, but it is called %d times", validated)
+	}
+}
+
+func TestToken_WarmUpValidationError(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	errInvalid := errors.New("invalid token")
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) {
+		c.WarmUpPeriod = time.Hour
+		c.ValidateToken = func(ctx context.Context, token *oauth2.Token) error { return errInvalid }
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if _, err := ts.Token(); !errors.Is(err, errInvalid) {
+		t.Errorf("want the validation error, got %v", err)
+	}
+}
+
+func TestNewAsyncRefreshingTokenSource_ShortRefreshInterval(t *testing.T) {
+	for _, tt := range []struct {
+		desc         string
+		autoExtend   bool
+		wantInterval string
+		wantLog      string
+	}{
+		{"warn", false, "1m0s", "much shorter than the token lifetime"},
+		{"auto extend", true, "30m0s", "is extended to 30m0s"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			now := time.Now()
+			fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+			logger := &recordingLogger{}
+			ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+				tokensource.WithRefreshInterval(time.Minute), tokensource.WithLogger(logger),
+				func(c *tokensource.AsyncRefreshingConfig) {
+					c.Clock = tokensourcetest.NewFakeClock(now)
+					c.AutoExtendRefreshInterval = tt.autoExtend
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ts.Close()
+
+			if !strings.Contains(logger.String(), tt.wantLog) {
+				t.Errorf("log must contain %q:\n%s", tt.wantLog, logger)
+			}
+			b, err := ts.DebugState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state struct {
+				Config struct {
+					RefreshInterval string `json:"refresh_interval"`
+				} `json:"config"`
+			}
+			if err := json.Unmarshal(b, &state); err != nil {
+				t.Fatal(err)
+			}
+			if state.Config.RefreshInterval != tt.wantInterval {
+				t.Errorf("RefreshInterval: want %v, got %v", tt.wantInterval, state.Config.RefreshInterval)
+			}
+		})
+	}
+}
+
+func TestExpectedScopes_WarnsMissingScopes(t *testing.T) {
+	token := (&oauth2.Token{AccessToken: "token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}).
+		WithExtra(map[string]interface{}{"scope": "scope-a scope-b"})
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.Response{Token: token})
+	logger := &recordingLogger{}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), tokensource.WithLogger(logger),
+		func(c *tokensource.AsyncRefreshingConfig) { c.ExpectedScopes = []string{"scope-a", "scope-c"} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	out := logger.String()
+	if want := "WARN: AsyncRefreshingTokenSource: token is not granted expected scopes [scope-c]"; !strings.Contains(out, want) {
+		t.Errorf("log must contain %q:\n%s", want, out)
+	}
+	if got, want := tokensource.GrantedScopes(token), []string{"scope-a", "scope-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GrantedScopes: want %v, got %v", want, got)
+	}
+}
+
+func TestRemainingLifetimeC(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	remainingC := make(chan time.Duration, 2)
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) {
+		c.Clock = clock
+		c.RemainingLifetimeC = remainingC
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	for _, want := range []time.Duration{time.Hour, 50 * time.Minute} {
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-remainingC; got != want {
+			t.Errorf("remaining lifetime: want %v, got %v", want, got)
+		}
+		clock.Advance(10 * time.Minute)
+	}
+
+	// Token() must not block when the receiver is not ready.
+	for i := 0; i < cap(remainingC)+1; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestToken_ConcurrentWithRefresh is meaningful with -race.
+func TestToken_ConcurrentWithRefresh(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(), func(c *tokensource.AsyncRefreshingConfig) {
+		c.MinForceRefreshInterval = -1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				token, err := ts.Token()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Read and write the fields of the returned token.
+				if token.AccessToken != "token" || token.Expiry.IsZero() {
+					t.Errorf("unexpected token %+v", token)
+					return
+				}
+				token.AccessToken = ""
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := ts.ForceRefresh(context.Background()); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRun_RecoversFromPanic(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	var mu sync.Mutex
+	var generated int
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		generated++
+		if generated == 2 {
+			panic("misbehaving credential plugin")
+		}
+		return fake, nil
+	}, tokensource.WithMarginBeforeExpiry(10*time.Minute), func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	clock.Advance(50 * time.Minute)
+	// The loop survives the panic and schedules the next refresh.
+	clock.WaitForTimers(1)
+	if err := ts.LastError(); !errors.Is(err, tokensource.ErrPanicked) {
+		t.Errorf("LastError: want ErrPanicked, got %v", err)
+	}
+	if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+		t.Errorf("the last token must be kept, got %v, %v", token, err)
+	}
+	clock.Advance(time.Hour)
+	waitForCalls(t, fake, 2)
+}
+
+func TestToken_RecoversFromPanic(t *testing.T) {
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		panic("misbehaving credential plugin")
+	}, func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if _, err := ts.Token(); !errors.Is(err, tokensource.ErrPanicked) {
+		t.Errorf("want ErrPanicked, got %v", err)
+	}
+}
+
+func TestRun_CancelDuringRetry(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)),
+		tokensourcetest.ErrorResponse(errors.New("temporary error")))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(ctx, fake.GenFunc(),
+		tokensource.WithMarginBeforeExpiry(10*time.Minute),
+		tokensource.WithRetryable(func(err error) bool { return true }),
+		tokensource.WithNewBackoff(func() backoff.BackOff { return backoff.NewConstantBackOff(time.Hour) }),
+		func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	clock.Advance(50 * time.Minute)
+	waitForCalls(t, fake, 2)
+	// The refresh waits for the retry by the timer of the backoff.
+	clock.WaitForTimers(1)
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+	defer shutdownCancel()
+	if err := ts.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("the retry must be aborted by the cancellation: %v", err)
+	}
+	if err := ts.LastError(); !errors.Is(err, context.Canceled) {
+		t.Errorf("LastError: want context.Canceled, got %v", err)
+	}
+	if calls := fake.Calls(); calls != 2 {
+		t.Errorf("want no retry after the cancellation, but Token() is called %d times", calls)
+	}
+}
+
+func TestToken_ConcurrentCallersShareRefresh(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return slowTokenSource{FakeTokenSource: fake, delay: 50 * time.Millisecond}, nil
+	}, func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+				t.Errorf("want token, got %v, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("concurrent callers must share one refresh, but Token() of the source is called %d times", calls)
+	}
+}
+
+func TestClose(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithMarginBeforeExpiry(10*time.Minute), func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.WaitForTimers(1)
+
+	for i := 0; i < 2; i++ {
+		if err := ts.Close(); err != nil {
+			t.Fatalf("Close must be idempotent: %v", err)
+		}
+	}
+	if _, err := ts.Token(); !errors.Is(err, tokensource.ErrClosed) {
+		t.Errorf("Token() after Close: want ErrClosed, got %v", err)
+	}
+	if _, err := ts.ForceRefresh(context.Background()); !errors.Is(err, tokensource.ErrClosed) {
+		t.Errorf("ForceRefresh after Close: want ErrClosed, got %v", err)
+	}
+	// The background loop exits without refreshing.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ts.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("the background loop must exit after Close: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("want no refresh after Close, but Token() of the source is called %d times", calls)
+	}
+}
+
+// blockingTokenSource blocks Token() after the first free calls until release is closed.
+type blockingTokenSource struct {
+	*tokensourcetest.FakeTokenSource
+	free    int
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *blockingTokenSource) Token() (*oauth2.Token, error) {
+	if s.FakeTokenSource.Calls() >= s.free {
+		s.once.Do(func() { close(s.started) })
+		<-s.release
+	}
+	return s.FakeTokenSource.Token()
+}
+
+func TestShutdown_WaitsForInFlightRefresh(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	source := &blockingTokenSource{FakeTokenSource: fake, free: 1, started: make(chan struct{}), release: make(chan struct{})}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return source, nil
+	}, tokensource.WithMarginBeforeExpiry(10*time.Minute), func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.WaitForTimers(1)
+	clock.Advance(50 * time.Minute)
+	<-source.started
+
+	shutdownC := make(chan error, 1)
+	go func() { shutdownC <- ts.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownC:
+		t.Fatalf("Shutdown must wait for the in-flight refresh, but returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The cached token is served while waiting.
+	if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+		t.Errorf("want the cached token while shutting down, got %v, %v", token, err)
+	}
+	close(source.release)
+	if err := <-shutdownC; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if _, err := ts.Token(); !errors.Is(err, tokensource.ErrClosed) {
+		t.Errorf("Token() after Shutdown: want ErrClosed, got %v", err)
+	}
+	if calls := fake.Calls(); calls != 2 {
+		t.Errorf("no refresh must start after Shutdown, but Token() of the source is called %d times", calls)
+	}
+}
+
+func TestShutdown_ContextDone(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	source := &blockingTokenSource{FakeTokenSource: fake, free: 1, started: make(chan struct{}), release: make(chan struct{})}
+	defer close(source.release)
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return source, nil
+	}, tokensource.WithMarginBeforeExpiry(10*time.Minute), func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.WaitForTimers(1)
+	clock.Advance(50 * time.Minute)
+	<-source.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ts.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := ts.Token(); !errors.Is(err, tokensource.ErrClosed) {
+		t.Errorf("Token() after Shutdown: want ErrClosed, got %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	errUnavailable := errors.New("unavailable")
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.ErrorResponse(errUnavailable), tokensourcetest.ErrorResponse(errUnavailable))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithCircuitBreaker(2, time.Minute), func(c *tokensource.AsyncRefreshingConfig) {
+			c.Clock = clock
+			c.LazyInit = true
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(); !errors.Is(err, errUnavailable) || errors.Is(err, tokensource.ErrCircuitOpen) {
+			t.Fatalf("failure %d: want the refresh error, got %v", i+1, err)
+		}
+	}
+	// The circuit is open after 2 consecutive failures, so Token() fails fast without refreshing.
+	_, err = ts.Token()
+	var circuitErr *tokensource.CircuitOpenError
+	if !errors.As(err, &circuitErr) || !errors.Is(err, errUnavailable) {
+		t.Fatalf("want *CircuitOpenError wrapping the last error, got %v", err)
+	}
+	if want := now.Add(time.Minute); !circuitErr.Until.Equal(want) {
+		t.Errorf("Until: want %v, got %v", want, circuitErr.Until)
+	}
+	if calls := fake.Calls(); calls != 2 {
+		t.Errorf("want no refresh while the circuit is open, but Token() of the source is called %d times", calls)
+	}
+
+	// After the cooldown, Token() refreshes again and a success closes the circuit.
+	fake.Push(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	clock.Advance(time.Minute)
+	if token, err := ts.Token(); err != nil || token.AccessToken != "token" {
+		t.Fatalf("want token after the cooldown, got %v, %v", token, err)
+	}
+	if got := ts.Stats().ConsecutiveFailures; got != 0 {
+		t.Errorf("ConsecutiveFailures: want 0, got %d", got)
+	}
+}
+
+func TestCircuitBreaker_ServesLastToken(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	// The token is within the early expiry window of oauth2, so Token() tries to refresh it.
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(5*time.Second)),
+		tokensourcetest.ErrorResponse(errors.New("unavailable")))
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithCircuitBreaker(1, time.Minute), func(c *tokensource.AsyncRefreshingConfig) { c.Clock = clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if _, err := ts.Token(); err == nil {
+		t.Fatal("want the refresh error")
+	}
+	token, err := ts.Token()
+	if err != nil || token.AccessToken != "token" {
+		t.Fatalf("want the last token while the circuit is open, got %v, %v", token, err)
+	}
+	if got := ts.Stats().ExpiredServed; got != 1 {
+		t.Errorf("ExpiredServed: want 1, got %d", got)
+	}
+}
+
+// ctxTokenSource blocks Token() until ctx is done, and reports the start of Token() to started.
+type ctxTokenSource struct {
+	ctx     context.Context
+	started chan<- struct{}
+}
+
+func (s ctxTokenSource) Token() (*oauth2.Token, error) {
+	s.started <- struct{}{}
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestClose_AbortsSharedRefresh(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return ctxTokenSource{ctx: ctx, started: started}, nil
+	}, tokensource.WithRetryable(func(err error) bool { return true }), func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := ts.Token()
+		errC <- err
+	}()
+	<-started
+	ts.Close()
+	select {
+	case err := <-errC:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close must abort the in-flight refresh of Token()")
+	}
+}
+
+func TestShutdown_WaitsForSynchronousRefresh(t *testing.T) {
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+	source := &blockingTokenSource{FakeTokenSource: fake, started: make(chan struct{}), release: make(chan struct{})}
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return source, nil
+	}, func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenC := make(chan error, 1)
+	go func() {
+		_, err := ts.Token()
+		tokenC <- err
+	}()
+	<-source.started
+
+	shutdownC := make(chan error, 1)
+	go func() { shutdownC <- ts.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownC:
+		t.Fatalf("Shutdown must wait for the refresh of Token(), but returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(source.release)
+	if err := <-tokenC; err != nil {
+		t.Errorf("the in-flight refresh must complete: %v", err)
+	}
+	if err := <-shutdownC; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdown_CancelsSynchronousRefresh(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), func(ctx context.Context) (oauth2.TokenSource, error) {
+		return ctxTokenSource{ctx: ctx, started: started}, nil
+	}, func(c *tokensource.AsyncRefreshingConfig) { c.LazyInit = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenC := make(chan error, 1)
+	go func() {
+		_, err := ts.Token()
+		tokenC <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ts.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded, got %v", err)
+	}
+	select {
+	case err := <-tokenC:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown must cancel the in-flight refresh when ctx is done")
+	}
+}
+
+func TestRun_BeforeRefreshSkipNearExpiry(t *testing.T) {
+	now := time.Now()
+	clock := tokensourcetest.NewFakeClock(now)
+	fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", now.Add(time.Hour)))
+	var mu sync.Mutex
+	var hookCalls int
+	ts, err := tokensource.NewAsyncRefreshingTokenSourceWithOptions(context.Background(), fake.GenFunc(),
+		tokensource.WithRefreshInterval(30*time.Minute), tokensource.WithMarginBeforeExpiry(10*time.Minute),
+		func(c *tokensource.AsyncRefreshingConfig) {
+			c.Clock = clock
+			c.MinRefreshWait = time.Minute
+			c.BeforeRefresh = func(ctx context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				hookCalls++
+				if hookCalls == 1 {
+					return errors.New("freeze window")
+				}
+				return nil
+			}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	clock.WaitForTimers(1)
+	clock.Advance(50 * time.Minute)
+	// The retry is scheduled after MinRefreshWait because the target time has passed, not after RefreshInterval.
+	waitForNextRefresh(t, ts, now.Add(51*time.Minute))
+	if calls := fake.Calls(); calls != 1 {
+		t.Errorf("the refresh must be skipped, but Token() is called %d times", calls)
+	}
+	clock.Advance(time.Minute)
+	waitForCalls(t, fake, 2)
+}
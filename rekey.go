@@ -0,0 +1,74 @@
+package tokensource
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// SmartAsyncAccessTokenSource is AsyncTokenSource generating access tokens by SmartAccessTokenSourceWithOptions,
+// whose scopes can be changed at runtime.
+type SmartAsyncAccessTokenSource struct {
+	*AsyncTokenSource
+
+	// mu serializes SetScopes, so opts always matches the latest genFunc.
+	mu   sync.Mutex
+	opts SmartOptions
+}
+
+// NewSmartAsyncAccessTokenSource create SmartAsyncAccessTokenSource generating access tokens by SmartAccessTokenSourceWithOptions with opts.
+// asyncOpts configure AsyncTokenSource like NewAsyncRefreshingTokenSourceWithOptions.
+func NewSmartAsyncAccessTokenSource(ctx context.Context, opts SmartOptions, asyncOpts ...Option) (*SmartAsyncAccessTokenSource, error) {
+	ts, err := NewAsyncRefreshingTokenSourceWithOptions(ctx, smartAccessTokenGenerator(opts), asyncOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SmartAsyncAccessTokenSource{AsyncTokenSource: ts, opts: opts}, nil
+}
+
+// SetScopes regenerates the token source with the new scopes and the other options unchanged, and refreshes the token immediately using ctx.
+// It is useful when the required scopes are expanded at runtime (e.g. by feature flags).
+// Token() keeps returning the last token until the new token is fetched. See SetGenerator for the error handling.
+func (s *SmartAsyncAccessTokenSource) SetScopes(ctx context.Context, scopes ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts.Scopes = append([]string(nil), scopes...)
+	return s.SetGenerator(ctx, smartAccessTokenGenerator(s.opts))
+}
+
+func smartAccessTokenGenerator(opts SmartOptions) func(ctx context.Context) (oauth2.TokenSource, error) {
+	return func(ctx context.Context) (oauth2.TokenSource, error) {
+		return SmartAccessTokenSourceWithOptions(ctx, opts)
+	}
+}
+
+// SmartAsyncIDTokenSource is AsyncTokenSource generating ID tokens by SmartIDTokenSourceWithOptions,
+// whose audience can be changed at runtime.
+type SmartAsyncIDTokenSource struct {
+	*AsyncTokenSource
+
+	opts IDOptions
+}
+
+// NewSmartAsyncIDTokenSource create SmartAsyncIDTokenSource generating ID tokens for audience by SmartIDTokenSourceWithOptions with opts.
+// asyncOpts configure AsyncTokenSource like NewAsyncRefreshingTokenSourceWithOptions.
+func NewSmartAsyncIDTokenSource(ctx context.Context, audience string, opts IDOptions, asyncOpts ...Option) (*SmartAsyncIDTokenSource, error) {
+	ts, err := NewAsyncRefreshingTokenSourceWithOptions(ctx, smartIDTokenGenerator(audience, opts), asyncOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SmartAsyncIDTokenSource{AsyncTokenSource: ts, opts: opts}, nil
+}
+
+// SetAudience regenerates the token source with the new audience and the same IDOptions, and refreshes the token immediately using ctx.
+// Token() keeps returning the last token until the new token is fetched. See SetGenerator for the error handling.
+func (s *SmartAsyncIDTokenSource) SetAudience(ctx context.Context, audience string) error {
+	return s.SetGenerator(ctx, smartIDTokenGenerator(audience, s.opts))
+}
+
+func smartIDTokenGenerator(audience string, opts IDOptions) func(ctx context.Context) (oauth2.TokenSource, error) {
+	return func(ctx context.Context) (oauth2.TokenSource, error) {
+		return SmartIDTokenSourceWithOptions(ctx, audience, opts)
+	}
+}
@@ -0,0 +1,97 @@
+package tokensource_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+
+	"github.com/apstndb/tokensource"
+	"github.com/apstndb/tokensource/tokensourcetest"
+)
+
+func TestSmartAsyncAccessTokenSource_SetScopesKeepsOptions(t *testing.T) {
+	var mu sync.Mutex
+	var gotScopes [][]string
+	opts := tokensource.SmartOptions{
+		Scopes: []string{"scope-a"},
+		// StrategyADC ignores CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT of the test environment.
+		Strategy: tokensource.StrategyADC,
+		Constructors: tokensource.Constructors{
+			FindDefaultCredentials: func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+				mu.Lock()
+				gotScopes = append(gotScopes, scopes)
+				mu.Unlock()
+				fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+				return &google.Credentials{TokenSource: fake, JSON: []byte(`{"type":"authorized_user"}`)}, nil
+			},
+		},
+	}
+	ts, err := tokensource.NewSmartAsyncAccessTokenSource(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if err := ts.SetScopes(context.Background(), "scope-b", "scope-c"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The custom FindDefaultCredentials is called again, so the other options are kept.
+	want := [][]string{{"scope-a"}, {"scope-b", "scope-c"}}
+	if !reflect.DeepEqual(gotScopes, want) {
+		t.Errorf("scopes: want %v, got %v", want, gotScopes)
+	}
+}
+
+func TestSmartAsyncIDTokenSource_SetAudienceKeepsOptions(t *testing.T) {
+	if os.Getenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT") != "" {
+		t.Skip("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is set")
+	}
+	var mu sync.Mutex
+	var gotAudiences []string
+	var gotOptions []int
+	opts := tokensource.IDOptions{
+		ClientOptions: []option.ClientOption{option.WithEndpoint("https://example.com")},
+		Constructors: tokensource.Constructors{
+			IDToken: func(ctx context.Context, audience string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+				mu.Lock()
+				gotAudiences = append(gotAudiences, audience)
+				gotOptions = append(gotOptions, len(opts))
+				mu.Unlock()
+				return tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse(audience, time.Now().Add(time.Hour))), nil
+			},
+		},
+	}
+	ts, err := tokensource.NewSmartAsyncIDTokenSource(context.Background(), "https://a.example.com", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if err := ts.SetAudience(context.Background(), "https://b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "https://b.example.com" {
+		t.Errorf("want the token for the new audience, got %q", token.AccessToken)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"https://a.example.com", "https://b.example.com"}; !reflect.DeepEqual(gotAudiences, want) {
+		t.Errorf("audiences: want %v, got %v", want, gotAudiences)
+	}
+	if want := []int{1, 1}; !reflect.DeepEqual(gotOptions, want) {
+		t.Errorf("number of ClientOptions: want %v, got %v", want, gotOptions)
+	}
+}
@@ -0,0 +1,66 @@
+package tokensource
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// impersonateStatusRe matches the status code in the errors of google.golang.org/api/impersonate, which are not typed.
+var impersonateStatusRe = regexp.MustCompile(`^impersonate: status code (\d+):`)
+
+// DefaultGoogleRetryable is the predicate for AsyncRefreshingConfig.IsRetryable which retries the transient errors of Google:
+// network timeouts and 408, 429, 500, 502, 503 and 504 from the token endpoints including the metadata server.
+// Auth errors (e.g. 400, 401 and 403) and context cancellation are not retried because they won't be resolved by retrying.
+func DefaultGoogleRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if code, ok := googleStatusCode(err); ok {
+		return isTransientStatus(code)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// googleStatusCode extracts the HTTP status code from the errors of token endpoints.
+func googleStatusCode(err error) (int, bool) {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		return retrieveErr.Response.StatusCode, true
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code, true
+	}
+	var metadataErr *metadata.Error
+	if errors.As(err, &metadataErr) {
+		return metadataErr.Code, true
+	}
+	if m := impersonateStatusRe.FindStringSubmatch(err.Error()); m != nil {
+		if code, err := strconv.Atoi(m[1]); err == nil {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
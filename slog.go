@@ -0,0 +1,52 @@
+//go:build go1.21
+// +build go1.21
+
+package tokensource
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// SlogLogger adapts l to Logger.
+// It implements RefreshEventLogger, so RefreshEvent is logged with structured attributes.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Debugf(format string, args ...interface{}) {
+	s.l.Debug(fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) Warnf(format string, args ...interface{}) {
+	s.l.Warn(fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) Errorf(format string, args ...interface{}) {
+	s.l.Error(fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) LogRefreshEvent(e RefreshEvent) {
+	level := slog.LevelDebug
+	switch e.Message {
+	case EventRefreshSucceeded:
+		level = slog.LevelInfo
+	case EventRefreshRetrying:
+		level = slog.LevelWarn
+	case EventRefreshFailed, EventRefreshGaveUp:
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{slog.Int("attempt", e.Attempt), slog.Duration("latency", e.Elapsed)}
+	if !e.Expiry.IsZero() {
+		attrs = append(attrs, slog.Time("expiry", e.Expiry))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.Any("error", e.Err))
+	}
+	s.l.LogAttrs(context.Background(), level, e.Message, attrs...)
+}
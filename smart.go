@@ -2,53 +2,452 @@ package tokensource
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
+	"time"
+	"unicode"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/idtoken"
 	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
 )
 
 const impSaEnvName = "CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT"
 
 // SmartIDTokenSource generate oauth2.TokenSource which generates ID token and supports CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT environment variable.
 func SmartIDTokenSource(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+	return SmartIDTokenSourceWithOptions(ctx, audience, IDOptions{})
+}
+
+// IDOptions is the options of SmartIDTokenSourceWithOptions.
+type IDOptions struct {
+	// OmitEmail omits email and email_verified claims from the impersonated ID token.
+	// By default, they are included because Cloud IAP requires email claim.
+	// Note: it only affects the impersonation. The claims of ID tokens generated by ADC without impersonation
+	// depend on the credential type and are not controlled by this option.
+	OmitEmail bool
+
+	// ClientOptions are passed to the underlying constructors (e.g. option.WithHTTPClient, option.WithEndpoint).
+	ClientOptions []option.ClientOption
+
+	// Constructors replace the underlying constructors, e.g. in tests.
+	Constructors Constructors
+}
+
+// SmartIDTokenSourceWithOptions is SmartIDTokenSource configured by opts.
+func SmartIDTokenSourceWithOptions(ctx context.Context, audience string, opts IDOptions) (oauth2.TokenSource, error) {
 	if impSaVal := os.Getenv(impSaEnvName); impSaVal != "" {
-		targetPrincipal, delegates := parseDelegateChain(impSaVal)
-		idCfg := impersonate.IDTokenConfig{
+		targetPrincipal, delegates, err := ParseDelegateChainE(impSaVal)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := impersonatedIDTokenSource(ctx, opts.Constructors, impersonate.IDTokenConfig{
 			Audience:        audience,
 			TargetPrincipal: targetPrincipal,
 			Delegates:       delegates,
-			// Cloud IAP requires email claim.
-			IncludeEmail: true,
+			IncludeEmail:    !opts.OmitEmail,
+		}, opts.ClientOptions...)
+		if err != nil {
+			return nil, err
+		}
+		return ts, nil
+	}
+
+	ts, err := opts.Constructors.idToken(ctx, audience, opts.ClientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &smartTokenSource{TokenSource: ts}, nil
+}
+
+// ParseDelegateChain split impersonate target principal and delegate chain.
+// s must be valid for ParseDelegateChainE, otherwise it panics.
+func ParseDelegateChain(s string) (targetPrincipal string, delegates []string) {
+	targetPrincipal, delegates, err := ParseDelegateChainE(s)
+	if err != nil {
+		panic("ParseDelegateChain: " + err.Error())
+	}
+	return targetPrincipal, delegates
+}
+
+// MaxDelegateHops is the maximum number of delegates in the delegate chain.
+// Longer chains are usually config mistakes (e.g. accidentally concatenated chains). Zero or negative value disables the check.
+var MaxDelegateHops = 10
+
+// checkDelegateHops returns an error if delegates exceed MaxDelegateHops.
+func checkDelegateHops(delegates []string) error {
+	if MaxDelegateHops > 0 && len(delegates) > MaxDelegateHops {
+		return fmt.Errorf("delegate chain has %d delegates, exceeding MaxDelegateHops %d", len(delegates), MaxDelegateHops)
+	}
+	return nil
+}
+
+// ParseDelegateChainE split impersonate target principal and delegate chain in the format of CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT.
+// Whitespaces around entries and trailing empty entries are dropped, e.g. " a , b , c ,\n" is target c with delegates [a, b].
+// It returns an error if s is empty or contains entries which are empty, contain whitespaces, or are not email addresses,
+// or if the delegates exceed MaxDelegateHops.
+func ParseDelegateChainE(s string) (targetPrincipal string, delegates []string, err error) {
+	return ParseDelegateChainWith(s, ",")
+}
+
+// ParseDelegateChainWith is ParseDelegateChainE with the separator sep instead of comma.
+// It is useful when the chain is assembled by systems reserving commas, e.g. "a;b;c" with sep ";".
+func ParseDelegateChainWith(s, sep string) (targetPrincipal string, delegates []string, err error) {
+	if sep == "" {
+		return "", nil, errors.New("empty delegate chain separator")
+	}
+	ss := splitDelegateChain(s, sep)
+	if len(ss) == 0 {
+		return "", nil, errors.New("empty delegate chain")
+	}
+	for i, principal := range ss {
+		if err := validatePrincipal(principal); err != nil {
+			return "", nil, fmt.Errorf("delegate chain entry %d %w", i+1, err)
+		}
+	}
+	if err := checkDelegateHops(ss[:len(ss)-1]); err != nil {
+		return "", nil, err
+	}
+	return ss[len(ss)-1], ss[:len(ss)-1], nil
+}
+
+// FormatDelegateChain joins delegates and targetPrincipal in the format of CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT.
+// It is the inverse of ParseDelegateChain.
+func FormatDelegateChain(targetPrincipal string, delegates []string) string {
+	return strings.Join(append(append([]string(nil), delegates...), targetPrincipal), ",")
+}
+
+// ValidateDelegateChain validates s like ParseDelegateChainE, and additionally requires all entries to be service account emails.
+func ValidateDelegateChain(s string) error {
+	if _, _, err := ParseDelegateChainE(s); err != nil {
+		return err
+	}
+	for i, principal := range splitDelegateChain(s, ",") {
+		if !strings.HasSuffix(principal, ".gserviceaccount.com") {
+			return fmt.Errorf("delegate chain entry %d is not a service account email: %q", i+1, principal)
 		}
-		return impersonate.IDTokenSource(ctx, idCfg)
 	}
+	return nil
+}
 
-	return idtoken.NewTokenSource(ctx, audience)
+// splitDelegateChain splits s by sep with trimming whitespaces of each entry and dropping trailing empty entries.
+func splitDelegateChain(s, sep string) []string {
+	ss := strings.Split(s, sep)
+	for i := range ss {
+		ss[i] = strings.TrimSpace(ss[i])
+	}
+	for len(ss) > 0 && ss[len(ss)-1] == "" {
+		ss = ss[:len(ss)-1]
+	}
+	return ss
 }
 
-// parseDelegateChain split impersonate target principal and delegate chain.
-// s must be non-empty string.
-func parseDelegateChain(s string) (targetPrincipal string, delegates []string) {
-	if s == "" {
-		panic("parseDelegateChain: empty argument")
+// validatePrincipal returns an error describing why principal is invalid in the form to follow "delegate chain entry N".
+func validatePrincipal(principal string) error {
+	switch {
+	case principal == "":
+		return errors.New("is empty")
+	case strings.IndexFunc(principal, unicode.IsSpace) >= 0:
+		return fmt.Errorf("contains whitespace: %q", principal)
+	case !isEmailLike(principal):
+		return fmt.Errorf("is not an email address: %q", principal)
+	default:
+		return nil
 	}
-	ss := strings.Split(s, ",")
-	return ss[len(ss)-1], ss[:len(ss)-1]
+}
+
+// isEmailLike reports whether s looks like an email address.
+func isEmailLike(s string) bool {
+	at := strings.Index(s, "@")
+	return at > 0 && at < len(s)-1 && strings.Count(s, "@") == 1
 }
 
 // SmartAccessTokenSource generate oauth2.TokenSource which generates access token and supports CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT environment variable.
+// Use ScopesFromEnv or SmartOptions.UseScopesEnv to read the scopes from TOKENSOURCE_SCOPES environment variable.
 func SmartAccessTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
-	if impSaVal := os.Getenv(impSaEnvName); impSaVal != "" {
-		targetPrincipal, delegates := parseDelegateChain(impSaVal)
-		return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+	return SmartAccessTokenSourceWithOptions(ctx, SmartOptions{Scopes: scopes})
+}
+
+const coreProjectEnvName = "CLOUDSDK_CORE_PROJECT"
+
+const scopesEnvName = "TOKENSOURCE_SCOPES"
+
+// ScopesFromEnv returns the comma separated scopes in TOKENSOURCE_SCOPES environment variable, or defaults if it is not set.
+// e.g. ScopesFromEnv(CloudPlatformScope) lets the environment override the default scope.
+func ScopesFromEnv(defaults ...string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(os.Getenv(scopesEnvName), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return defaults
+	}
+	return scopes
+}
+
+// SmartOptions is the options of SmartAccessTokenSourceWithOptions.
+type SmartOptions struct {
+	// Scopes are the OAuth 2.0 scopes of the access token.
+	Scopes []string
+
+	// UseScopesEnv makes TOKENSOURCE_SCOPES environment variable used if Scopes is empty. See ScopesFromEnv.
+	// It is opt-in so that the environment doesn't change the scopes of the libraries using this package unexpectedly.
+	UseScopesEnv bool
+
+	// QuotaProject is the project for quota and billing of the API calls with the token.
+	// If it is empty, CLOUDSDK_CORE_PROJECT environment variable is used.
+	// Use QuotaProject function to retrieve it from the token source.
+	QuotaProject string
+
+	// Lifetime is the lifetime of the impersonated access token. It must not exceed 1 hour.
+	// If it is zero, the default lifetime (1 hour) is used.
+	// It is ignored if impersonation is not active.
+	Lifetime time.Duration
+
+	// Subject is the email of the Google Workspace user to act as using domain-wide delegation.
+	// The service account must be granted domain-wide delegation of Scopes in the Workspace admin console,
+	// and Scopes must be the Workspace API scopes (e.g. https://www.googleapis.com/auth/admin.directory.user.readonly).
+	// Without impersonation, ADC or CredentialsFile must be a service account key and ClientOptions must be empty, otherwise an error is returned.
+	Subject string
+
+	// ClientOptions are passed to the underlying constructors (e.g. option.WithHTTPClient, option.WithEndpoint).
+	// Without impersonation, they are used to find the credentials (e.g. option.WithCredentialsFile).
+	ClientOptions []option.ClientOption
+
+	// CredentialsFile is the path of the credentials JSON file used instead of ADC.
+	// It supports service account keys, authorized users and external accounts (workload identity federation).
+	// With impersonation, it is used as the source credentials.
+	CredentialsFile string
+
+	// MetadataProbeTimeout limits the time to find ADC and fetch the first token from the metadata server.
+	// It makes the construction fail fast outside of GCE instead of hanging. It is not applied to impersonation.
+	// If it is zero, the timeouts of the underlying libraries are used.
+	MetadataProbeTimeout time.Duration
+
+	// Constructors replace the underlying constructors, e.g. in tests.
+	Constructors Constructors
+
+	// Strategy forces the way to generate tokens. StrategyAuto (default) chooses it by the environment.
+	// If the forced Strategy is not available, an error is returned.
+	Strategy Strategy
+}
+
+// Strategy is the way SmartAccessTokenSourceWithStrategy generates tokens.
+type Strategy int
+
+const (
+	// StrategyAuto uses impersonation if CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is set, otherwise ADC.
+	StrategyAuto Strategy = iota
+	// StrategyImpersonate impersonates the service account in CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT.
+	StrategyImpersonate
+	// StrategyADC uses the credentials file found by ADC (e.g. GOOGLE_APPLICATION_CREDENTIALS, gcloud auth application-default login).
+	// CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is ignored if it is forced.
+	StrategyADC
+	// StrategyMetadata uses the metadata server found by ADC (e.g. GCE, GKE, Cloud Run).
+	// CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT is ignored if it is forced.
+	StrategyMetadata
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyAuto:
+		return "auto"
+	case StrategyImpersonate:
+		return "impersonate"
+	case StrategyADC:
+		return "adc"
+	case StrategyMetadata:
+		return "metadata"
+	default:
+		return fmt.Sprintf("Strategy(%d)", int(s))
+	}
+}
+
+// maxImpersonatedLifetime is the maximum lifetime of the impersonated access token allowed by IAM.
+const maxImpersonatedLifetime = time.Hour
+
+// SmartAccessTokenSourceWithOptions is SmartAccessTokenSource configured by opts.
+func SmartAccessTokenSourceWithOptions(ctx context.Context, opts SmartOptions) (oauth2.TokenSource, error) {
+	ts, _, err := SmartAccessTokenSourceWithStrategy(ctx, opts)
+	return ts, err
+}
+
+// SmartAccessTokenSourceWithStrategy is SmartAccessTokenSourceWithOptions which also returns the resolved Strategy.
+// It is useful to log how the credentials are resolved at startup.
+func SmartAccessTokenSourceWithStrategy(ctx context.Context, opts SmartOptions) (oauth2.TokenSource, Strategy, error) {
+	// TOKENSOURCE_SCOPES is only used by opt-in, and never overrides the explicit scopes.
+	if len(opts.Scopes) == 0 && opts.UseScopesEnv {
+		opts.Scopes = ScopesFromEnv()
+	}
+	ts, strategy, err := smartAccessTokenSource(ctx, opts)
+	if err != nil {
+		return nil, StrategyAuto, err
+	}
+	ts.quotaProject = opts.QuotaProject
+	if ts.quotaProject == "" {
+		ts.quotaProject = os.Getenv(coreProjectEnvName)
+	}
+	return ts, strategy, nil
+}
+
+func smartAccessTokenSource(ctx context.Context, opts SmartOptions) (*smartTokenSource, Strategy, error) {
+	if opts.Lifetime > maxImpersonatedLifetime {
+		return nil, StrategyAuto, fmt.Errorf("invalid SmartOptions: Lifetime must not exceed %v, but got %v", maxImpersonatedLifetime, opts.Lifetime)
+	}
+	impSaVal := os.Getenv(impSaEnvName)
+	switch opts.Strategy {
+	case StrategyAuto, StrategyADC, StrategyMetadata:
+	case StrategyImpersonate:
+		if impSaVal == "" {
+			return nil, StrategyAuto, fmt.Errorf("Strategy %v is forced, but %s is not set", opts.Strategy, impSaEnvName)
+		}
+	default:
+		return nil, StrategyAuto, fmt.Errorf("invalid SmartOptions: unknown Strategy %v", opts.Strategy)
+	}
+
+	if impSaVal != "" && (opts.Strategy == StrategyAuto || opts.Strategy == StrategyImpersonate) {
+		targetPrincipal, delegates, err := ParseDelegateChainE(impSaVal)
+		if err != nil {
+			return nil, StrategyAuto, err
+		}
+		ts, err := impersonatedAccessTokenSource(ctx, opts.Constructors, impersonate.CredentialsConfig{
 			TargetPrincipal: targetPrincipal,
 			Delegates:       delegates,
-			Scopes:          scopes,
-		})
+			Scopes:          opts.Scopes,
+			Lifetime:        opts.Lifetime,
+			Subject:         opts.Subject,
+		}, opts.clientOptions()...)
+		if err != nil {
+			return nil, StrategyAuto, err
+		}
+		return ts, StrategyImpersonate, nil
+	}
+
+	if opts.MetadataProbeTimeout > 0 {
+		return probeDefaultTokenSource(ctx, opts)
+	}
+	return defaultTokenSource(ctx, opts)
+}
+
+// defaultTokenSource generates oauth2.TokenSource by ADC.
+func defaultTokenSource(ctx context.Context, opts SmartOptions) (*smartTokenSource, Strategy, error) {
+	creds, err := defaultCredentials(ctx, opts)
+	if err != nil {
+		return nil, StrategyAuto, err
+	}
+	// ADC without JSON means the credentials are provided by the metadata server.
+	strategy := StrategyADC
+	if len(creds.JSON) == 0 {
+		strategy = StrategyMetadata
+	}
+	if opts.Strategy != StrategyAuto && opts.Strategy != strategy {
+		return nil, StrategyAuto, fmt.Errorf("Strategy %v is forced, but ADC is resolved to %v", opts.Strategy, strategy)
+	}
+	return &smartTokenSource{TokenSource: creds.TokenSource, identity: credentialsIdentity(creds.JSON)}, strategy, nil
+}
+
+// probeDefaultTokenSource is defaultTokenSource which fails if ADC or the first token from the metadata server is not available
+// within opts.MetadataProbeTimeout. The probe continues in background after the timeout.
+func probeDefaultTokenSource(ctx context.Context, opts SmartOptions) (*smartTokenSource, Strategy, error) {
+	type result struct {
+		ts       *smartTokenSource
+		strategy Strategy
+		err      error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		ts, strategy, err := defaultTokenSource(ctx, opts)
+		if err == nil && strategy == StrategyMetadata {
+			var token *oauth2.Token
+			if token, err = ts.Token(); err == nil {
+				ts.TokenSource = oauth2.ReuseTokenSource(token, ts.TokenSource)
+			}
+		}
+		resultC <- result{ts: ts, strategy: strategy, err: err}
+	}()
+
+	timer := time.NewTimer(opts.MetadataProbeTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			return nil, StrategyAuto, r.err
+		}
+		return r.ts, r.strategy, nil
+	case <-timer.C:
+		return nil, StrategyAuto, fmt.Errorf("ADC is unavailable: no response within MetadataProbeTimeout %v (not on GCE?)", opts.MetadataProbeTimeout)
+	case <-ctx.Done():
+		return nil, StrategyAuto, ctx.Err()
+	}
+}
+
+// defaultCredentials finds the credentials by ADC.
+func defaultCredentials(ctx context.Context, opts SmartOptions) (*google.Credentials, error) {
+	if opts.Subject != "" {
+		return subjectCredentials(ctx, opts)
+	}
+	if clientOpts := opts.clientOptions(); len(clientOpts) > 0 {
+		return transport.Creds(ctx, append([]option.ClientOption{option.WithScopes(opts.Scopes...)}, clientOpts...)...)
+	}
+	return opts.Constructors.findDefaultCredentials(ctx, opts.Scopes...)
+}
+
+// clientOptions returns ClientOptions with CredentialsFile.
+func (opts SmartOptions) clientOptions() []option.ClientOption {
+	if opts.CredentialsFile == "" {
+		return opts.ClientOptions
+	}
+	return append(append([]option.ClientOption(nil), opts.ClientOptions...), option.WithCredentialsFile(opts.CredentialsFile))
+}
+
+// subjectCredentials finds the service account key by ADC to generate access token of opts.Subject.
+func subjectCredentials(ctx context.Context, opts SmartOptions) (*google.Credentials, error) {
+	if len(opts.ClientOptions) > 0 {
+		return nil, errors.New("invalid SmartOptions: Subject without impersonation doesn't support ClientOptions")
+	}
+	params := google.CredentialsParams{Scopes: opts.Scopes, Subject: opts.Subject}
+	var creds *google.Credentials
+	var err error
+	if opts.CredentialsFile != "" {
+		var b []byte
+		if b, err = os.ReadFile(opts.CredentialsFile); err == nil {
+			creds, err = google.CredentialsFromJSONWithParams(ctx, b, params)
+		}
+	} else {
+		creds, err = google.FindDefaultCredentialsWithParams(ctx, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(creds.JSON, &f); err != nil || f.Type != "service_account" {
+		return nil, errors.New("invalid SmartOptions: Subject requires impersonation or a service account key")
+	}
+	return creds, nil
+}
+
+// smartTokenSource is oauth2.TokenSource which carries the quota project and Identity.
+type smartTokenSource struct {
+	oauth2.TokenSource
+	quotaProject string
+	identity     Identity
+}
+
+// QuotaProject returns the quota project carried by ts created by SmartAccessTokenSourceWithOptions.
+// It returns empty string if ts doesn't carry the quota project.
+// Pass it to the API clients (e.g. option.WithQuotaProject) to send X-Goog-User-Project header.
+func QuotaProject(ts oauth2.TokenSource) string {
+	if sts, ok := ts.(*smartTokenSource); ok {
+		return sts.quotaProject
 	}
-	return google.DefaultTokenSource(ctx, scopes...)
+	return ""
 }
@@ -0,0 +1,121 @@
+package tokensource_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+
+	"github.com/apstndb/tokensource"
+	"github.com/apstndb/tokensource/tokensourcetest"
+)
+
+func TestFormatDelegateChain_RoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		desc            string
+		targetPrincipal string
+		delegates       []string
+		want            string
+	}{
+		{"no delegate", "target@p.iam.gserviceaccount.com", nil, "target@p.iam.gserviceaccount.com"},
+		{"one delegate", "target@p.iam.gserviceaccount.com", []string{"a@p.iam.gserviceaccount.com"}, "a@p.iam.gserviceaccount.com,target@p.iam.gserviceaccount.com"},
+		{"two delegates", "target@p.iam.gserviceaccount.com", []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"}, "a@p.iam.gserviceaccount.com,b@p.iam.gserviceaccount.com,target@p.iam.gserviceaccount.com"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := tokensource.FormatDelegateChain(tt.targetPrincipal, tt.delegates)
+			if s != tt.want {
+				t.Errorf("FormatDelegateChain: want %q, got %q", tt.want, s)
+			}
+			targetPrincipal, delegates := tokensource.ParseDelegateChain(s)
+			if targetPrincipal != tt.targetPrincipal {
+				t.Errorf("target principal: want %q, got %q", tt.targetPrincipal, targetPrincipal)
+			}
+			if len(delegates) != len(tt.delegates) || (len(delegates) > 0 && !reflect.DeepEqual(delegates, tt.delegates)) {
+				t.Errorf("delegates: want %q, got %q", tt.delegates, delegates)
+			}
+		})
+	}
+}
+
+func TestParseDelegateChainE(t *testing.T) {
+	for _, tt := range []struct {
+		desc                string
+		s                   string
+		wantTargetPrincipal string
+		wantDelegates       []string
+		wantErr             bool
+	}{
+		{"single", "c@example.com", "c@example.com", nil, false},
+		{"chain", "a@example.com,b@example.com,c@example.com", "c@example.com", []string{"a@example.com", "b@example.com"}, false},
+		{"whitespaces", " a@example.com , b@example.com , c@example.com ", "c@example.com", []string{"a@example.com", "b@example.com"}, false},
+		{"trailing comma and newline", "a@example.com,c@example.com,\n", "c@example.com", []string{"a@example.com"}, false},
+		{"single with trailing comma", "c@example.com,", "c@example.com", nil, false},
+		{"empty", "", "", nil, true},
+		{"only separators", " , ,", "", nil, true},
+		{"empty entry in the middle", "a@example.com,,c@example.com", "", nil, true},
+		{"whitespace in entry", "a @example.com,c@example.com", "", nil, true},
+		{"not email", "a,c@example.com", "", nil, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			targetPrincipal, delegates, err := tokensource.ParseDelegateChainE(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if targetPrincipal != tt.wantTargetPrincipal {
+				t.Errorf("target principal: want %q, got %q", tt.wantTargetPrincipal, targetPrincipal)
+			}
+			if len(delegates) != len(tt.wantDelegates) || (len(delegates) > 0 && !reflect.DeepEqual(delegates, tt.wantDelegates)) {
+				t.Errorf("delegates: want %q, got %q", tt.wantDelegates, delegates)
+			}
+		})
+	}
+}
+
+func TestSmartAccessTokenSourceWithOptions_UseScopesEnv(t *testing.T) {
+	old, ok := os.LookupEnv("TOKENSOURCE_SCOPES")
+	os.Setenv("TOKENSOURCE_SCOPES", "scope-env-a, scope-env-b")
+	defer func() {
+		if ok {
+			os.Setenv("TOKENSOURCE_SCOPES", old)
+		} else {
+			os.Unsetenv("TOKENSOURCE_SCOPES")
+		}
+	}()
+
+	for _, tt := range []struct {
+		desc         string
+		scopes       []string
+		useScopesEnv bool
+		want         []string
+	}{
+		{"not opted in", nil, false, nil},
+		{"opted in", nil, true, []string{"scope-env-a", "scope-env-b"}},
+		{"explicit scopes", []string{"scope-a"}, true, []string{"scope-a"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var got []string
+			_, err := tokensource.SmartAccessTokenSourceWithOptions(context.Background(), tokensource.SmartOptions{
+				Scopes:       tt.scopes,
+				UseScopesEnv: tt.useScopesEnv,
+				// StrategyADC ignores CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT of the test environment.
+				Strategy: tokensource.StrategyADC,
+				Constructors: tokensource.Constructors{
+					FindDefaultCredentials: func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+						got = scopes
+						fake := tokensourcetest.NewFakeTokenSource(tokensourcetest.TokenResponse("token", time.Now().Add(time.Hour)))
+						return &google.Credentials{TokenSource: fake, JSON: []byte(`{"type":"authorized_user"}`)}, nil
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("scopes: want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package tokensource
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrTokenExpired is returned by the TokenSource of StaticTokenSource after the token is expired.
+var ErrTokenExpired = errors.New("static token is expired")
+
+type staticTokenSource struct {
+	token *oauth2.Token
+}
+
+func (ts staticTokenSource) Token() (*oauth2.Token, error) {
+	if !ts.token.Valid() {
+		return nil, ErrTokenExpired
+	}
+	return cloneToken(ts.token), nil
+}
+
+// StaticTokenSource returns oauth2.TokenSource which always returns tok.
+// Unlike oauth2.StaticTokenSource, it returns ErrTokenExpired after tok is expired.
+// It is useful for tests and for bridging tokens obtained out-of-band.
+func StaticTokenSource(tok *oauth2.Token) oauth2.TokenSource {
+	return staticTokenSource{token: cloneToken(tok)}
+}
+
+// NewStaticAsyncRefreshingTokenSource create AsyncTokenSource serving tok,
+// so static tokens can be handled in the same code path as dynamically refreshed tokens.
+func NewStaticAsyncRefreshingTokenSource(ctx context.Context, conf AsyncRefreshingConfig, tok *oauth2.Token) (*AsyncTokenSource, error) {
+	ts := StaticTokenSource(tok)
+	return NewAsyncRefreshingTokenSource(ctx, conf, func(ctx context.Context) (oauth2.TokenSource, error) {
+		return ts, nil
+	})
+}
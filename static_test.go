@@ -0,0 +1,46 @@
+package tokensource_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/apstndb/tokensource"
+)
+
+func TestNewStaticAsyncRefreshingTokenSource(t *testing.T) {
+	tok := &oauth2.Token{AccessToken: "static", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+	ts, err := tokensource.NewStaticAsyncRefreshingTokenSource(context.Background(), tokensource.AsyncRefreshingConfig{}, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// Mutating tok after the construction must not affect the served token.
+	tok.AccessToken = "mutated"
+	for i := 0; i < 2; i++ {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "static" {
+			t.Errorf("want static, got %q", token.AccessToken)
+		}
+	}
+	if token, err := ts.ForceRefresh(context.Background()); err != nil || token.AccessToken != "static" {
+		t.Errorf("ForceRefresh: want static, got %v, %v", token, err)
+	}
+}
+
+func TestStaticTokenSource_Expired(t *testing.T) {
+	ts := tokensource.StaticTokenSource(&oauth2.Token{AccessToken: "static", Expiry: time.Now().Add(-time.Minute)})
+	if _, err := ts.Token(); !errors.Is(err, tokensource.ErrTokenExpired) {
+		t.Errorf("want ErrTokenExpired, got %v", err)
+	}
+	if _, err := tokensource.NewStaticAsyncRefreshingTokenSource(context.Background(), tokensource.AsyncRefreshingConfig{}, &oauth2.Token{AccessToken: "static", Expiry: time.Now().Add(-time.Minute)}); !errors.Is(err, tokensource.ErrTokenExpired) {
+		t.Errorf("want ErrTokenExpired from the constructor, got %v", err)
+	}
+}
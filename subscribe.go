@@ -0,0 +1,60 @@
+package tokensource
+
+import (
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenEvent notifies the subscribers that the token is refreshed.
+type TokenEvent struct {
+	Token       *oauth2.Token
+	RefreshedAt time.Time
+}
+
+// Subscribe returns the channel which receives TokenEvent every time the token is refreshed successfully.
+// Events are delivered best-effort: they are dropped if the receiver is slow, so refreshing is never blocked.
+// The channel is closed by Unsubscribe or Close.
+func (ts *AsyncTokenSource) Subscribe() <-chan TokenEvent {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	c := make(chan TokenEvent, 1)
+	if ts.closed {
+		close(c)
+		return c
+	}
+	if ts.subscribers == nil {
+		ts.subscribers = make(map[<-chan TokenEvent]chan TokenEvent)
+	}
+	ts.subscribers[c] = c
+	return c
+}
+
+// Unsubscribe stops delivering events to c returned by Subscribe and closes it.
+func (ts *AsyncTokenSource) Unsubscribe(c <-chan TokenEvent) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if sub, ok := ts.subscribers[c]; ok {
+		delete(ts.subscribers, c)
+		close(sub)
+	}
+}
+
+// publishLocked notifies the subscribers of token without blocking. ts.mu must be held.
+func (ts *AsyncTokenSource) publishLocked(token *oauth2.Token) {
+	refreshedAt := ts.conf.Clock.Now()
+	for _, sub := range ts.subscribers {
+		select {
+		case sub <- TokenEvent{Token: cloneToken(token), RefreshedAt: refreshedAt}:
+		default:
+		}
+	}
+}
+
+// closeSubscribersLocked closes all the subscriptions. ts.mu must be held.
+func (ts *AsyncTokenSource) closeSubscribersLocked() {
+	for c, sub := range ts.subscribers {
+		delete(ts.subscribers, c)
+		close(sub)
+	}
+}
@@ -0,0 +1,43 @@
+package tokensource
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// CloudPlatformScope is the OAuth 2.0 scope to access most of Google Cloud APIs.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// IsGoogleAPI reports whether u is a Google API endpoint (*.googleapis.com) which requires access token.
+// It is the default heuristic of SmartTokenSourceForTarget.
+func IsGoogleAPI(u *url.URL) bool {
+	host := u.Hostname()
+	return host == "googleapis.com" || strings.HasSuffix(host, ".googleapis.com")
+}
+
+// SmartTokenSourceForTarget generate oauth2.TokenSource for targetURL.
+// For Google APIs, it generates access token with CloudPlatformScope, or the scopes in TOKENSOURCE_SCOPES environment variable if it is set.
+// Otherwise, it generates ID token with targetURL as the audience
+// (e.g. Cloud Run, Cloud Functions, Cloud IAP).
+func SmartTokenSourceForTarget(ctx context.Context, targetURL string) (oauth2.TokenSource, error) {
+	return SmartTokenSourceForTargetWith(ctx, targetURL, IsGoogleAPI)
+}
+
+// SmartTokenSourceForTargetWith is SmartTokenSourceForTarget with the heuristic needsAccessToken instead of IsGoogleAPI.
+func SmartTokenSourceForTargetWith(ctx context.Context, targetURL string, needsAccessToken func(u *url.URL) bool) (oauth2.TokenSource, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("target URL must be absolute: %q", targetURL)
+	}
+	if needsAccessToken(u) {
+		return SmartAccessTokenSource(ctx, ScopesFromEnv(CloudPlatformScope)...)
+	}
+	return SmartIDTokenSource(ctx, targetURL)
+}
@@ -0,0 +1,184 @@
+// Package tokensourcetest provides fakes to test code depending on tokensource without calling Google APIs.
+package tokensourcetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/apstndb/tokensource"
+)
+
+// ErrNoResponse is returned by FakeTokenSource when no response is scripted.
+var ErrNoResponse = errors.New("tokensourcetest: no response is scripted")
+
+// Response is a scripted result of FakeTokenSource.Token().
+type Response struct {
+	Token *oauth2.Token
+	Err   error
+}
+
+// TokenResponse returns Response of the token with accessToken and expiry.
+func TokenResponse(accessToken string, expiry time.Time) Response {
+	return Response{Token: &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer", Expiry: expiry}}
+}
+
+// ErrorResponse returns Response of err.
+func ErrorResponse(err error) Response {
+	return Response{Err: err}
+}
+
+// FakeTokenSource is oauth2.TokenSource which returns the scripted responses in order.
+// After all responses are consumed, the last response is repeated.
+type FakeTokenSource struct {
+	mu        sync.Mutex
+	responses []Response
+	last      *Response
+	calls     int
+}
+
+// NewFakeTokenSource creates FakeTokenSource scripted with responses.
+func NewFakeTokenSource(responses ...Response) *FakeTokenSource {
+	return &FakeTokenSource{responses: append([]Response(nil), responses...)}
+}
+
+// Push appends responses to the script.
+func (f *FakeTokenSource) Push(responses ...Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, responses...)
+}
+
+// Token returns the next scripted response.
+func (f *FakeTokenSource) Token() (*oauth2.Token, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.responses) > 0 {
+		f.last = &f.responses[0]
+		f.responses = f.responses[1:]
+	}
+	if f.last == nil {
+		return nil, ErrNoResponse
+	}
+	if f.last.Err != nil || f.last.Token == nil {
+		return nil, f.last.Err
+	}
+	token := *f.last.Token
+	return &token, nil
+}
+
+// Calls returns how many times Token() is called.
+func (f *FakeTokenSource) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// GenFunc returns genFunc of AsyncTokenSource which always returns f.
+func (f *FakeTokenSource) GenFunc() func(ctx context.Context) (oauth2.TokenSource, error) {
+	return func(ctx context.Context) (oauth2.TokenSource, error) {
+		return f, nil
+	}
+}
+
+// FakeClock is tokensource.Clock whose time advances only by Advance.
+// Set it to AsyncRefreshingConfig.Clock for deterministic testing of refresh timing.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ tokensource.Clock = (*FakeClock)(nil)
+
+// NewFakeClock creates FakeClock starting at now.
+// oauth2.Token.Valid always uses the real time, so now should be close to time.Now() in most cases.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates tokensource.Timer which fires when the fake time reaches now + d.
+func (c *FakeClock) NewTimer(d time.Duration) tokensource.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance advances the fake time by d and fires the timers whose deadline is passed.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+	c.timers = pending
+}
+
+// WaitForTimers blocks until at least n timers are pending.
+// It is useful to wait for the background refresh to be scheduled before Advance.
+func (c *FakeClock) WaitForTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// PendingTimers returns the number of timers which have not fired nor been stopped.
+func (c *FakeClock) PendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
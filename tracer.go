@@ -0,0 +1,24 @@
+package tokensource
+
+import "context"
+
+// RefreshTrigger describes why a refresh is performed.
+type RefreshTrigger string
+
+const (
+	// TriggerInitial is the first token fetch in NewAsyncRefreshingTokenSource, or in the first Token(), ForceRefresh or WaitReady with LazyInit.
+	TriggerInitial RefreshTrigger = "initial"
+	// TriggerBackground is the refresh in the background loop.
+	TriggerBackground RefreshTrigger = "background"
+	// TriggerOnDemand is the synchronous refresh in Token() or TokenContext.
+	TriggerOnDemand RefreshTrigger = "on_demand"
+	// TriggerForced is the refresh by ForceRefresh.
+	TriggerForced RefreshTrigger = "forced"
+)
+
+// RefreshTracer traces each refresh of AsyncTokenSource.
+type RefreshTracer interface {
+	// StartRefresh is called before each refresh. The returned context is used for the refresh,
+	// and end is called with the result after the refresh, including all retries.
+	StartRefresh(ctx context.Context, trigger RefreshTrigger) (_ context.Context, end func(err error))
+}
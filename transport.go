@@ -0,0 +1,55 @@
+package tokensource
+
+import (
+	"io"
+	"net/http"
+)
+
+type authRetryTransport struct {
+	base       http.RoundTripper
+	ts         *AsyncTokenSource
+	maxRetries int
+}
+
+// RoundTripper returns http.RoundTripper which authorizes requests with the token of ts.
+// When the upstream responds 401 or 403, it calls ts.ForceRefresh and retries the request with the new token up to maxRetries times.
+// Requests with a body are retried only if Request.GetBody is set. If base is nil, http.DefaultTransport is used.
+func RoundTripper(base http.RoundTripper, ts *AsyncTokenSource, maxRetries int) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &authRetryTransport{base: base, ts: ts, maxRetries: maxRetries}
+}
+
+func (t *authRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	token, err := t.ts.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(ctx)
+		if attempt > 0 && req.GetBody != nil {
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		token.SetAuthHeader(r)
+		resp, err := t.base.RoundTrip(r)
+		if err != nil || !isAuthFailure(resp.StatusCode) || attempt >= t.maxRetries || !replayable {
+			return resp, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		t.ts.conf.Logger.Debugf("AsyncRefreshingTokenSource: refreshing token because the request is responded %q", resp.Status)
+		if token, err = t.ts.ForceRefresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isAuthFailure(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}